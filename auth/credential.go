@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/winguse/go-shp/utils"
+)
+
+// Self-issued proxy credentials
+//
+// After the OAuth login, the server mints its own credential instead of handing the
+// provider token to the client. The format is "c1.<key id>.<claims>.<signature>",
+// claims is the unpadded base64url JSON of CredentialClaims and the signature is
+// HMAC-SHA256 over everything before it. It can be verified offline.
+
+const credentialVersion = "c1"
+
+// DefaultCredentialTTL is used when credential_ttl is not configured
+const DefaultCredentialTTL = 30 * 24 * time.Hour
+
+// DefaultRefreshCredentialTTL is used when refresh_credential_ttl is not configured
+const DefaultRefreshCredentialTTL = 365 * 24 * time.Hour
+
+// ErrCredentialExpired the credential is signed by us, but expired
+var ErrCredentialExpired = errors.New("credential expired")
+
+// CredentialClaims the payload of a self-issued credential
+type CredentialClaims struct {
+	Email     string `json:"email"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	// Refresh credentials can only be used to get new credentials, but not to proxy
+	Refresh bool   `json:"rt,omitempty"`
+	KeyID   string `json:"-"`
+}
+
+// CredentialSigner mints and verifies self-issued credentials
+type CredentialSigner struct {
+	keys        map[string][]byte
+	activeKeyID string
+	ttl         time.Duration
+	refreshTTL  time.Duration
+}
+
+// IsCredential reports if the token looks like a self-issued credential
+func IsCredential(token string) bool {
+	return strings.HasPrefix(token, credentialVersion+".")
+}
+
+// NewCredentialSigner a CredentialSigner signing with the active key of keyring,
+// credentials signed by the other keys in keyring are still accepted.
+func NewCredentialSigner(keyring *utils.Keyring, ttl time.Duration, refreshTTL time.Duration) (*CredentialSigner, error) {
+	keys := make(map[string][]byte)
+	for _, id := range keyring.KeyIDs() {
+		key, err := keyring.DeriveKey(id, "go-shp credential")
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = key
+	}
+	if ttl <= 0 {
+		ttl = DefaultCredentialTTL
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = DefaultRefreshCredentialTTL
+	}
+	return &CredentialSigner{
+		keys:        keys,
+		activeKeyID: keyring.ActiveKeyID(),
+		ttl:         ttl,
+		refreshTTL:  refreshTTL,
+	}, nil
+}
+
+func signCredential(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue a credential for email
+func (s *CredentialSigner) Issue(email string) (string, *CredentialClaims, error) {
+	return s.issue(email, false)
+}
+
+// IssueRefresh issues a refresh credential for email
+func (s *CredentialSigner) IssueRefresh(email string) (string, *CredentialClaims, error) {
+	return s.issue(email, true)
+}
+
+func (s *CredentialSigner) issue(email string, refresh bool) (string, *CredentialClaims, error) {
+	ttl := s.ttl
+	if refresh {
+		ttl = s.refreshTTL
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	claims := &CredentialClaims{
+		Email:     email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        hex.EncodeToString(id),
+		Refresh:   refresh,
+		KeyID:     s.activeKeyID,
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	signed := credentialVersion + "." + s.activeKeyID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signCredential(s.keys[s.activeKeyID], signed), claims, nil
+}
+
+// Verify the signature and expiration of credential and returns its claims,
+// the claims are returned along with ErrCredentialExpired if it is only expired.
+func (s *CredentialSigner) Verify(credential string) (*CredentialClaims, error) {
+	return s.verify(credential, false)
+}
+
+// VerifyRefresh verifies a refresh credential
+func (s *CredentialSigner) VerifyRefresh(credential string) (*CredentialClaims, error) {
+	return s.verify(credential, true)
+}
+
+func (s *CredentialSigner) verify(credential string, refresh bool) (*CredentialClaims, error) {
+	parts := strings.Split(credential, ".")
+	if len(parts) != 4 || parts[0] != credentialVersion {
+		return nil, errors.New("malformed credential")
+	}
+	key, ok := s.keys[parts[1]]
+	if !ok {
+		return nil, errors.New("unknown credential key id")
+	}
+	signed := credential[:len(credential)-len(parts[3])-1]
+	if !hmac.Equal([]byte(signCredential(key, signed)), []byte(parts[3])) {
+		return nil, errors.New("invalid credential signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	claims := &CredentialClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	claims.KeyID = parts[1]
+	if claims.Refresh != refresh {
+		return nil, errors.New("unexpected kind of credential")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, ErrCredentialExpired
+	}
+	return claims, nil
+}
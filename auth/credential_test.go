@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/winguse/go-shp/utils"
+)
+
+func newTestSigner(t *testing.T, secret string, ttl time.Duration) *CredentialSigner {
+	keyring, err := utils.NewKeyring([]utils.AESKey{{Secret: secret}}, true)
+	assert.NoError(t, err)
+	signer, err := NewCredentialSigner(keyring, ttl, 0)
+	assert.NoError(t, err)
+	return signer
+}
+
+func TestCredentialSigner(t *testing.T) {
+	signer := newTestSigner(t, "my-secret-key", time.Hour)
+
+	credential, claims, err := signer.Issue("user@example.com")
+	assert.NoError(t, err)
+	assert.True(t, IsCredential(credential))
+	assert.Equal(t, "user@example.com", claims.Email)
+	assert.Equal(t, claims.IssuedAt+3600, claims.ExpiresAt)
+
+	verified, err := signer.Verify(credential)
+	if assert.NoError(t, err) {
+		assert.Equal(t, claims.Email, verified.Email)
+		assert.Equal(t, claims.ID, verified.ID)
+		assert.Equal(t, claims.KeyID, verified.KeyID)
+	}
+
+	// Tampered claims
+	parts := strings.Split(credential, ".")
+	parts[2] = parts[2][:len(parts[2])-2] + "xx"
+	_, err = signer.Verify(strings.Join(parts, "."))
+	assert.Error(t, err)
+
+	// Signed by another secret
+	other := newTestSigner(t, "another-secret", time.Hour)
+	_, err = other.Verify(credential)
+	assert.Error(t, err)
+
+	// Malformed
+	_, err = signer.Verify("c1.not-a-credential")
+	assert.Error(t, err)
+	assert.False(t, IsCredential("SR:refresh-token"))
+}
+
+func TestCredentialKeyRotation(t *testing.T) {
+	oldKeyring, _ := utils.NewKeyring([]utils.AESKey{{ID: "k1", Secret: "old"}}, true)
+	oldSigner, _ := NewCredentialSigner(oldKeyring, time.Hour, 0)
+	credential, _, err := oldSigner.Issue("user@example.com")
+	assert.NoError(t, err)
+
+	keyring, _ := utils.NewKeyring([]utils.AESKey{{ID: "k2", Secret: "new"}, {ID: "k1", Secret: "old"}}, true)
+	signer, _ := NewCredentialSigner(keyring, time.Hour, 0)
+	claims, err := signer.Verify(credential)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k1", claims.KeyID)
+	}
+	_, claims, _ = signer.Issue("user@example.com")
+	assert.Equal(t, "k2", claims.KeyID)
+}
+
+func TestCredentialExpired(t *testing.T) {
+	signer := newTestSigner(t, "my-secret-key", time.Nanosecond)
+	credential, _, err := signer.Issue("user@example.com")
+	assert.NoError(t, err)
+
+	time.Sleep(time.Second)
+	_, err = signer.Verify(credential)
+	assert.EqualError(t, err, "credential expired")
+}
+
+func TestRefreshCredential(t *testing.T) {
+	backend := newTestBackend(t)
+	refresh, _, err := backend.signer.IssueRefresh("user@example.com")
+	assert.NoError(t, err)
+
+	// refresh credential cannot be used to proxy
+	_, err = backend.signer.Verify(refresh)
+	assert.Error(t, err)
+
+	rec := httptest.NewRecorder()
+	backend.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/oauth/refresh", strings.NewReader(`{"refresh_token":"`+refresh+`"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	info := &AccessTokenInfo{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), info))
+	claims, err := backend.signer.Verify(info.AccessToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user@example.com", claims.Email)
+	}
+	assert.InDelta(t, DefaultCredentialTTL.Seconds(), info.ExpiresInSec, 5)
+
+	rec = httptest.NewRecorder()
+	backend.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/oauth/token-info", strings.NewReader(`{"access_token":"`+info.AccessToken+`"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// credential cannot be used to refresh
+	rec = httptest.NewRecorder()
+	backend.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/oauth/refresh", strings.NewReader(`{"refresh_token":"`+info.AccessToken+`"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// revoked user cannot refresh
+	backend.Revocations, err = NewRevocationList(filepath.Join(t.TempDir(), "revocation.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Revocations.RevokeEmail("user@example.com"))
+	rec = httptest.NewRecorder()
+	backend.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/oauth/refresh", strings.NewReader(`{"refresh_token":"`+refresh+`"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestTokenInfoRevoked(t *testing.T) {
+	backend := newTestBackend(t)
+	var err error
+	backend.Revocations, err = NewRevocationList(filepath.Join(t.TempDir(), "revocation.json"))
+	assert.NoError(t, err)
+	tokenInfo := func(credential string) int {
+		rec := httptest.NewRecorder()
+		backend.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/oauth/token-info", strings.NewReader(`{"access_token":"`+credential+`"}`)))
+		return rec.Code
+	}
+
+	byFingerprint, _, err := backend.signer.Issue("fingerprint@example.com")
+	assert.NoError(t, err)
+	byEmail, _, err := backend.signer.Issue("email@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, tokenInfo(byFingerprint))
+	assert.Equal(t, http.StatusOK, tokenInfo(byEmail))
+
+	assert.NoError(t, backend.Revocations.RevokeFingerprint(TokenFingerprint(byFingerprint)))
+	assert.NoError(t, backend.Revocations.RevokeEmail("email@example.com"))
+	assert.Equal(t, http.StatusBadRequest, tokenInfo(byFingerprint))
+	assert.Equal(t, http.StatusBadRequest, tokenInfo(byEmail))
+
+	byIssueTime, _, err := backend.signer.Issue("user@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, tokenInfo(byIssueTime))
+	assert.NoError(t, backend.Revocations.RevokeIssuedBefore(time.Now().Add(time.Second)))
+	assert.Equal(t, http.StatusBadRequest, tokenInfo(byIssueTime))
+}
@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device authorization, similar to RFC 8628, so headless clients can log in:
+// the client requests a code by "device/code", the user approves it by logging in
+// on "device" with a browser, and the client polls "device/token" for the credential.
+// After the login, the user confirms the device on a page carrying a CSRF token bound to
+// the device_session cookie, the device is never approved by the login alone.
+
+const (
+	deviceCodeTTL      = 10 * time.Minute
+	devicePollInterval = 5
+	maxPendingDevices  = 1024
+	userCodeAlphabet   = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLen        = 8
+)
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Device Login</title></head>
+<body style="font-family: sans-serif; max-width: 30em; margin: 3em auto; padding: 0 1em;">
+{{if .Approved}}<h1>Device approved</h1><p>The device is logged in as <b>{{.Email}}</b>, you can close this page now.</p>
+{{else if .Confirm}}<h1>Approve the device?</h1>
+<p>You are signed in as <b>{{.Email}}</b>. Approve the device showing the code <b>{{.UserCode}}</b> only if you requested it yourself.</p>
+<form method="post" action="{{.Action}}"><input type="hidden" name="user_code" value="{{.UserCode}}"><input type="hidden" name="email" value="{{.Email}}"><input type="hidden" name="expires" value="{{.Expires}}"><input type="hidden" name="csrf_token" value="{{.CSRFToken}}"> <button type="submit">Approve</button></form>
+{{else}}<h1>Device Login</h1>
+<p>Enter the code shown on your device, then sign in to approve it. If you are sent to sign in with the provider, enter the code again afterwards. Only approve the code you requested yourself.</p>
+<form method="post" action="{{.Action}}"><input name="user_code" value="{{.UserCode}}" autocomplete="off" style="font-size: 1.5em; letter-spacing: 0.1em;"> <button type="submit">Approve</button></form>
+{{end}}</body></html>`))
+
+// DeviceCodeResponse the response of "device/code"
+type DeviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresInSec    int    `json:"expires_in"`
+	IntervalSec     int    `json:"interval"`
+}
+
+// DeviceTokenRequest the request of "device/token"
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"device_code"`
+}
+
+// DeviceTokenResponse the response of "device/token", Error is set if not approved yet
+type DeviceTokenResponse struct {
+	Error        string `json:"error,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInSec int    `json:"expires_in,omitempty"`
+}
+
+type deviceAuthorization struct {
+	deviceCode string
+	userCode   string
+	expires    time.Time
+	email      string
+	credential string
+	refresh    string
+	claims     *CredentialClaims
+}
+
+type deviceAuthorizations struct {
+	l            sync.Mutex
+	byDeviceCode map[string]*deviceAuthorization
+	byUserCode   map[string]*deviceAuthorization
+}
+
+func newDeviceAuthorizations() *deviceAuthorizations {
+	return &deviceAuthorizations{
+		byDeviceCode: make(map[string]*deviceAuthorization),
+		byUserCode:   make(map[string]*deviceAuthorization),
+	}
+}
+
+func randomUserCode() (string, error) {
+	b := make([]byte, userCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = userCodeAlphabet[int(b[i])%len(userCodeAlphabet)]
+	}
+	return string(b[:userCodeLen/2]) + "-" + string(b[userCodeLen/2:]), nil
+}
+
+// normalizeUserCode so that the code typed by user matches regardless of case and dash
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.TrimSpace(userCode))
+	userCode = strings.ReplaceAll(userCode, "-", "")
+	if len(userCode) != userCodeLen {
+		return ""
+	}
+	return userCode[:userCodeLen/2] + "-" + userCode[userCodeLen/2:]
+}
+
+// removeExpired must be called with the lock held
+func (d *deviceAuthorizations) removeExpired(now time.Time) {
+	for deviceCode, device := range d.byDeviceCode {
+		if now.After(device.expires) {
+			delete(d.byDeviceCode, deviceCode)
+			delete(d.byUserCode, device.userCode)
+		}
+	}
+}
+
+func (d *deviceAuthorizations) create() (*deviceAuthorization, bool) {
+	deviceCode := make([]byte, 32)
+	if _, err := rand.Read(deviceCode); err != nil {
+		return nil, false
+	}
+	userCode, err := randomUserCode()
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.removeExpired(now)
+	if len(d.byDeviceCode) >= maxPendingDevices {
+		return nil, false
+	}
+	if _, ok := d.byUserCode[userCode]; ok {
+		return nil, false
+	}
+	device := &deviceAuthorization{
+		deviceCode: hex.EncodeToString(deviceCode),
+		userCode:   userCode,
+		expires:    now.Add(deviceCodeTTL),
+	}
+	d.byDeviceCode[device.deviceCode] = device
+	d.byUserCode[device.userCode] = device
+	return device, true
+}
+
+// isPending reports if the user code is waiting for approval
+func (d *deviceAuthorizations) isPending(userCode string) bool {
+	d.l.Lock()
+	defer d.l.Unlock()
+	device, ok := d.byUserCode[userCode]
+	return ok && device.email == "" && time.Now().Before(device.expires)
+}
+
+func (d *deviceAuthorizations) approve(userCode string, email string, credential string, refresh string, claims *CredentialClaims) bool {
+	d.l.Lock()
+	defer d.l.Unlock()
+	device, ok := d.byUserCode[userCode]
+	if !ok || device.email != "" || time.Now().After(device.expires) {
+		return false
+	}
+	device.email = email
+	device.credential = credential
+	device.refresh = refresh
+	device.claims = claims
+	return true
+}
+
+// poll returns the approved device and forgets it, or the error code of RFC 8628
+func (d *deviceAuthorizations) poll(deviceCode string) (*deviceAuthorization, string) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	device, ok := d.byDeviceCode[deviceCode]
+	if !ok {
+		return nil, "invalid_grant"
+	}
+	if time.Now().After(device.expires) {
+		delete(d.byDeviceCode, deviceCode)
+		delete(d.byUserCode, device.userCode)
+		return nil, "expired_token"
+	}
+	if device.email == "" {
+		return nil, "authorization_pending"
+	}
+	delete(d.byDeviceCode, deviceCode)
+	delete(d.byUserCode, device.userCode)
+	return device, ""
+}
+
+// API for client to start a device login
+func (o *OAuthBackend) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 METHOD NOT ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+	// a burst from one source must not fill up the pending devices for all
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+	if o.deviceRequests.IsBlocked(sourceIP) {
+		http.Error(w, "too many device codes requested", http.StatusTooManyRequests)
+		return
+	}
+	o.deviceRequests.Fail(sourceIP)
+	device, ok := o.devices.create()
+	if !ok {
+		http.Error(w, "too many pending devices", http.StatusServiceUnavailable)
+		return
+	}
+	makeJSONResponse(w, &DeviceCodeResponse{
+		DeviceCode:      device.deviceCode,
+		UserCode:        device.userCode,
+		VerificationURI: o.config.OAuth.RedirectURL + "device",
+		ExpiresInSec:    int(deviceCodeTTL.Seconds()),
+		IntervalSec:     devicePollInterval,
+	})
+}
+
+// handle the user to approve a device, the user code is kept in cookie during the OAuth login
+func (o *OAuthBackend) handleDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		userCode := normalizeUserCode(r.PostFormValue("user_code"))
+		if userCode == "" || !o.devices.isPending(userCode) {
+			http.Error(w, "invalid or expired code", http.StatusBadRequest)
+			return
+		}
+		w.Header().Add("Set-Cookie", "user_code="+userCode+"; Max-Age=600; Path="+o.RedirectBasePath+"; Secure; HttpOnly; SameSite=Strict")
+		w.Header().Add("Location", o.RedirectBasePath)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	w.Header().Add("Referrer-Policy", "no-referrer")
+	w.Header().Add("Content-Type", "text/html; charset=UTF-8")
+	err := deviceTemplate.Execute(w, map[string]any{
+		"Action":   o.RedirectBasePath + "device",
+		"UserCode": r.URL.Query().Get("user_code"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deviceCSRFToken binds the confirmation of the device to the session, the email and the expiry
+func (o *OAuthBackend) deviceCSRFToken(session string, userCode string, email string, expires int64) string {
+	mac := hmac.New(sha256.New, o.deviceKey)
+	mac.Write([]byte(session + "\n" + userCode + "\n" + email + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// confirmDevice asks the signed-in user to confirm the device in user_code cookie if any, returns if asked
+func (o *OAuthBackend) confirmDevice(w http.ResponseWriter, r *http.Request, email string) bool {
+	userCodeCookie, err := r.Cookie("user_code")
+	if err != nil {
+		return false
+	}
+	w.Header().Add("Set-Cookie", "user_code=; Max-Age=-1; Path="+o.RedirectBasePath+"; Secure; HttpOnly; SameSite=Strict")
+	userCode := normalizeUserCode(userCodeCookie.Value)
+	if userCode == "" || !o.devices.isPending(userCode) {
+		return false
+	}
+	session := make([]byte, 32)
+	if _, err := rand.Read(session); err != nil {
+		return false
+	}
+	sessionID := hex.EncodeToString(session)
+	expires := time.Now().Add(deviceCodeTTL).Unix()
+	w.Header().Add("Set-Cookie", "device_session="+sessionID+"; Max-Age=600; Path="+o.RedirectBasePath+"; Secure; HttpOnly; SameSite=Strict")
+	w.Header().Add("Referrer-Policy", "no-referrer")
+	w.Header().Add("Content-Type", "text/html; charset=UTF-8")
+	deviceTemplate.Execute(w, map[string]any{
+		"Confirm":   true,
+		"Action":    o.RedirectBasePath + "device/approve",
+		"UserCode":  userCode,
+		"Email":     email,
+		"Expires":   expires,
+		"CSRFToken": o.deviceCSRFToken(sessionID, userCode, email, expires),
+	})
+	return true
+}
+
+// handle the user confirming the device on the page of confirmDevice
+func (o *OAuthBackend) handleDeviceApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 METHOD NOT ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionCookie, err := r.Cookie("device_session")
+	if err != nil || sessionCookie.Value == "" {
+		http.Error(w, "invalid session", http.StatusForbidden)
+		return
+	}
+	userCode := normalizeUserCode(r.PostFormValue("user_code"))
+	email := r.PostFormValue("email")
+	expires, err := strconv.ParseInt(r.PostFormValue("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		http.Error(w, "invalid or expired confirmation", http.StatusForbidden)
+		return
+	}
+	expected := o.deviceCSRFToken(sessionCookie.Value, userCode, email, expires)
+	if !hmac.Equal([]byte(expected), []byte(r.PostFormValue("csrf_token"))) {
+		http.Error(w, "invalid or expired confirmation", http.StatusForbidden)
+		return
+	}
+	w.Header().Add("Set-Cookie", "device_session=; Max-Age=-1; Path="+o.RedirectBasePath+"; Secure; HttpOnly; SameSite=Strict")
+	credential, claims, err := o.signer.Issue(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refresh, _, err := o.signer.IssueRefresh(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !o.devices.approve(userCode, email, credential, refresh, claims) {
+		http.Error(w, "invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Referrer-Policy", "no-referrer")
+	w.Header().Add("Content-Type", "text/html; charset=UTF-8")
+	deviceTemplate.Execute(w, map[string]any{
+		"Approved": true,
+		"Email":    email,
+	})
+}
+
+// API for client to poll the credential of an approved device
+func (o *OAuthBackend) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 METHOD NOT ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+	input := &DeviceTokenRequest{}
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	device, errCode := o.devices.poll(input.DeviceCode)
+	if device == nil {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		makeJSONResponse(w, &DeviceTokenResponse{Error: errCode})
+		return
+	}
+	makeJSONResponse(w, &DeviceTokenResponse{
+		Email:        device.email,
+		Token:        device.credential,
+		RefreshToken: device.refresh,
+		ExpiresInSec: int(device.claims.ExpiresAt - time.Now().Unix()),
+	})
+}
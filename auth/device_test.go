@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBackend(t *testing.T) *OAuthBackend {
+	cfg := &Config{
+		ValidEmail: ".*",
+		AESSecret:  "test-aes-secret",
+	}
+	cfg.OAuth.RedirectURL = "https://example.com/oauth/"
+	backend := &OAuthBackend{}
+	assert.NoError(t, backend.Init(cfg))
+	return backend
+}
+
+func pollDeviceToken(backend *OAuthBackend, deviceCode string) (int, *DeviceTokenResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/device/token", strings.NewReader(`{"device_code":"`+deviceCode+`"}`))
+	rec := httptest.NewRecorder()
+	backend.HandleRequest(rec, req)
+	token := &DeviceTokenResponse{}
+	json.Unmarshal(rec.Body.Bytes(), token)
+	return rec.Code, token
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	backend := newTestBackend(t)
+
+	rec := httptest.NewRecorder()
+	backend.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/oauth/device/code", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	code := &DeviceCodeResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), code))
+	assert.Equal(t, "https://example.com/oauth/device", code.VerificationURI)
+	assert.Len(t, code.UserCode, 9)
+
+	status, token := pollDeviceToken(backend, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "authorization_pending", token.Error)
+
+	// user enters the code in lower case without dash
+	form := url.Values{"user_code": {strings.ToLower(strings.ReplaceAll(code.UserCode, "-", ""))}}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	backend.HandleRequest(rec, req)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Contains(t, rec.Header().Get("Set-Cookie"), "user_code="+code.UserCode)
+
+	assert.Contains(t, rec.Header().Get("Set-Cookie"), "SameSite=Strict")
+
+	// after the OAuth login, the user is asked to confirm, the login alone approves nothing
+	req = httptest.NewRequest(http.MethodGet, "/oauth/", nil)
+	req.AddCookie(&http.Cookie{Name: "user_code", Value: code.UserCode})
+	rec = httptest.NewRecorder()
+	assert.True(t, backend.confirmDevice(rec, req, "user@example.com"))
+	assert.Contains(t, rec.Body.String(), "user@example.com")
+	assert.Contains(t, rec.Body.String(), code.UserCode)
+	status, token = pollDeviceToken(backend, code.DeviceCode)
+	assert.Equal(t, "authorization_pending", token.Error)
+
+	session := ""
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "device_session" {
+			session = cookie.Value
+		}
+	}
+	assert.NotEmpty(t, session)
+	form = url.Values{}
+	for _, field := range regexp.MustCompile(`name="(\w+)" value="([^"]*)"`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		form.Set(field[1], field[2])
+	}
+	approve := func(form url.Values, session string) int {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/device/approve", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "device_session", Value: session})
+		}
+		rec := httptest.NewRecorder()
+		backend.HandleRequest(rec, req)
+		return rec.Code
+	}
+
+	// cross-site posts carry no session, or a token not bound to it
+	assert.Equal(t, http.StatusForbidden, approve(form, ""))
+	assert.Equal(t, http.StatusForbidden, approve(form, "other-session"))
+	forged := url.Values{}
+	for k, v := range form {
+		forged[k] = v
+	}
+	forged.Set("email", "attacker@example.com")
+	assert.Equal(t, http.StatusForbidden, approve(forged, session))
+
+	assert.Equal(t, http.StatusOK, approve(form, session))
+
+	status, token = pollDeviceToken(backend, code.DeviceCode)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "user@example.com", token.Email)
+	claims, err := backend.VerifyCredential(token.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user@example.com", claims.Email)
+	}
+
+	// the credential is handed out only once
+	_, token = pollDeviceToken(backend, code.DeviceCode)
+	assert.Equal(t, "invalid_grant", token.Error)
+}
+
+func TestDeviceInvalidUserCode(t *testing.T) {
+	backend := newTestBackend(t)
+
+	form := url.Values{"user_code": {"BCDF-GHJK"}}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	backend.HandleRequest(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/oauth/", nil)
+	req.AddCookie(&http.Cookie{Name: "user_code", Value: "BCDF-GHJK"})
+	assert.False(t, backend.confirmDevice(httptest.NewRecorder(), req, "user@example.com"))
+
+	assert.Equal(t, "", normalizeUserCode("short"))
+}
+
+func TestDeviceCodeLimit(t *testing.T) {
+	backend := newTestBackend(t)
+	requestCode := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/device/code", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		backend.HandleRequest(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, requestCode("192.0.2.1:1234"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, requestCode("192.0.2.1:5678"))
+	assert.Equal(t, http.StatusOK, requestCode("192.0.2.2:1234"))
+	assert.Equal(t, 11, len(backend.devices.byDeviceCode))
+
+	// polling is POST only
+	rec := httptest.NewRecorder()
+	backend.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/oauth/device/token", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
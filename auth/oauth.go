@@ -26,7 +26,7 @@ var renderTemplate = template.Must(template.New("render").Parse(`<script src="{{
 type Config struct {
 	OAuth struct { // the same as oauth2.Config, but we need to attach yaml annotation here
 		ClientID     string   `yaml:"client_id"`
-		ClientSecret string   `yaml:"client_secret"`
+		ClientSecret string   `yaml:"client_secret" redact:"secret"`
 		Endpoint     struct { // the same as oauth2.Endpoint, but we need to attach yaml annotation here
 			AuthURL   string           `yaml:"auth_url"`
 			TokenURL  string           `yaml:"token_url"`
@@ -38,8 +38,24 @@ type Config struct {
 	TokenInfoAPI string `yaml:"token_info_api"`
 	RenderJsSrc  string `yaml:"render_js_src"`
 	ValidEmail   string `yaml:"valid_email"`
-	AESSecret    string `yaml:"aes_secret"`
+	AESSecret    string `yaml:"aes_secret" redact:"secret"`
 	MaxTokenLen  int    `yaml:"max_token_len"`
+	// CredentialTTL is the lifetime of self-issued credentials, default 30 days
+	CredentialTTL time.Duration `yaml:"credential_ttl"`
+	// RefreshCredentialTTL is the lifetime of refresh credentials, default 365 days
+	RefreshCredentialTTL time.Duration `yaml:"refresh_credential_ttl"`
+	// AESKeys are used before AESSecret, the first key signs the credentials, the others verify only
+	AESKeys []utils.AESKey `yaml:"aes_keys"`
+	// RejectLegacyTokens rejects the AES wrapped provider tokens, only the credentials are accepted
+	RejectLegacyTokens bool `yaml:"reject_legacy_tokens"`
+	// CheckTimeout of checking a token with the provider, default 10 seconds
+	CheckTimeout time.Duration `yaml:"check_timeout"`
+	// KeepWrappedTokens keeps the AES wrapped provider tokens valid after revoke-issued-before,
+	// they carry no issue time, so any cutoff revokes them all otherwise
+	KeepWrappedTokens bool `yaml:"keep_wrapped_tokens"`
+	// DeviceCodeLimit of the device codes requested per source IP, threshold is the codes in window,
+	// 10 per minute by default, then the source IP is refused for block_duration
+	DeviceCodeLimit utils.FailureTrackerConfig `yaml:"device_code_limit"`
 }
 
 // OAuthBackend holding the runtime state
@@ -49,6 +65,12 @@ type OAuthBackend struct {
 	RedirectBasePath string
 	routeMap         map[string]func(http.ResponseWriter, *http.Request)
 	validEmailRegexp *regexp.Regexp
+	signer           *CredentialSigner
+	keyring          *utils.Keyring
+	devices          *deviceAuthorizations
+	deviceRequests   *utils.FailureTracker // of device/code per source IP
+	deviceKey        []byte                // of the CSRF tokens confirming the devices
+	Revocations      *RevocationList
 }
 
 // RefreshTokenInfo the datastructure of refresh token
@@ -80,6 +102,16 @@ type GithubEmail struct {
 	Visibility string `json:"visibility"`
 }
 
+// NewKeyring builds the keyring from aes_keys and aes_secret, the first of aes_keys is active if any
+func NewKeyring(config *Config) (*utils.Keyring, error) {
+	keys := make([]utils.AESKey, 0, len(config.AESKeys)+1)
+	keys = append(keys, config.AESKeys...)
+	if config.AESSecret != "" {
+		keys = append(keys, utils.AESKey{Secret: config.AESSecret})
+	}
+	return utils.NewKeyring(keys, !config.RejectLegacyTokens)
+}
+
 // Init the OAuthBackend
 func (o *OAuthBackend) Init(config *Config) error {
 	redirectURL, err := url.Parse(config.OAuth.RedirectURL)
@@ -90,9 +122,25 @@ func (o *OAuthBackend) Init(config *Config) error {
 	if err != nil {
 		return err
 	}
+	keyring, err := NewKeyring(config)
+	if err != nil {
+		return err
+	}
+	signer, err := NewCredentialSigner(keyring, config.CredentialTTL, config.RefreshCredentialTTL)
+	if err != nil {
+		return err
+	}
 
 	o.config = config
 	o.validEmailRegexp = validEmailRegexp
+	o.signer = signer
+	o.keyring = keyring
+	o.devices = newDeviceAuthorizations()
+	o.deviceRequests = utils.NewFailureTracker(config.DeviceCodeLimit)
+	o.deviceKey, err = keyring.DeriveKey(keyring.ActiveKeyID(), "go-shp device confirmation")
+	if err != nil {
+		return err
+	}
 	o.oauth2Config = &oauth2.Config{
 		ClientID:     config.OAuth.ClientID,
 		ClientSecret: config.OAuth.ClientSecret,
@@ -106,17 +154,25 @@ func (o *OAuthBackend) Init(config *Config) error {
 	}
 	o.RedirectBasePath = redirectURL.Path
 	o.routeMap = map[string]func(http.ResponseWriter, *http.Request){
-		"":           o.handleRoot,
-		"refresh":    o.handleRefresh,
-		"token-info": o.handleTokenInfo,
-		"health":     o.handleHealthCheck,
-		"logout":     o.handleLogout,
+		"":               o.handleRoot,
+		"refresh":        o.handleRefresh,
+		"token-info":     o.handleTokenInfo,
+		"health":         o.handleHealthCheck,
+		"logout":         o.handleLogout,
+		"device":         o.handleDevice,
+		"device/code":    o.handleDeviceCode,
+		"device/token":   o.handleDeviceToken,
+		"device/approve": o.handleDeviceApprove,
 	}
 	return nil
 }
 
-func getJSON(client *http.Client, url string, v any) error {
-	res, err := client.Get(url)
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -139,18 +195,18 @@ func makeJSONResponse(w http.ResponseWriter, v any) {
 
 // CheckRefreshToken is to do authentication directly by refresh token.
 // It can be not the best paractice and slower, but it works. This will allow client don't need to worry about refreshing.
-func (o *OAuthBackend) CheckRefreshToken(refreshToken string) (*TokenInfo, error) {
-	token, err := o.refreshToken(refreshToken)
+func (o *OAuthBackend) CheckRefreshToken(ctx context.Context, refreshToken string) (*TokenInfo, error) {
+	token, err := o.refreshToken(ctx, refreshToken)
 	if err != nil {
 		return nil, err
 	}
-	return o.CheckAccessToken(token.AccessToken)
+	return o.CheckAccessToken(ctx, token.AccessToken)
 }
 
 // CheckAccessToken if the access token is valid
-func (o *OAuthBackend) CheckAccessToken(accessToken string) (*TokenInfo, error) {
+func (o *OAuthBackend) CheckAccessToken(ctx context.Context, accessToken string) (*TokenInfo, error) {
 	tokenInfo := &TokenInfo{}
-	client := o.oauth2Config.Client(context.Background(), &oauth2.Token{AccessToken: accessToken})
+	client := o.oauth2Config.Client(ctx, &oauth2.Token{AccessToken: accessToken})
 
 	if strings.Contains(o.config.TokenInfoAPI, "api.github.com") {
 		// check the token belongs to this application
@@ -158,7 +214,7 @@ func (o *OAuthBackend) CheckAccessToken(accessToken string) (*TokenInfo, error)
 		if err != nil {
 			return nil, err
 		}
-		req, err := http.NewRequest(
+		req, err := http.NewRequestWithContext(ctx,
 			http.MethodPost,
 			"https://api.github.com/applications/"+o.oauth2Config.ClientID+"/token",
 			bytes.NewReader(bodyBytes))
@@ -174,7 +230,7 @@ func (o *OAuthBackend) CheckAccessToken(accessToken string) (*TokenInfo, error)
 			return nil, errors.New("github token api returned " + res.Status + " instead of 2XX")
 		}
 		var githubEmails []GithubEmail
-		err = getJSON(client, o.config.TokenInfoAPI, &githubEmails)
+		err = getJSON(ctx, client, o.config.TokenInfoAPI, &githubEmails)
 		if err != nil {
 			return nil, err
 		}
@@ -189,7 +245,7 @@ func (o *OAuthBackend) CheckAccessToken(accessToken string) (*TokenInfo, error)
 			}
 		}
 	} else {
-		err := getJSON(client, o.config.TokenInfoAPI, tokenInfo)
+		err := getJSON(ctx, client, o.config.TokenInfoAPI, tokenInfo)
 		if err != nil {
 			return nil, err
 		}
@@ -211,17 +267,28 @@ func (o *OAuthBackend) CheckAccessToken(accessToken string) (*TokenInfo, error)
 	return tokenInfo, nil
 }
 
-func (o *OAuthBackend) refreshToken(refreshToken string) (*oauth2.Token, error) {
+// DecryptToken decrypts the client token wrapping the provider token
+func (o *OAuthBackend) DecryptToken(token string) (string, bool) {
+	rawToken, err := o.keyring.Decrypt(token)
+	return rawToken, err == nil
+}
+
+// VerifyCredential checks a self-issued credential offline
+func (o *OAuthBackend) VerifyCredential(credential string) (*CredentialClaims, error) {
+	return o.signer.Verify(credential)
+}
+
+func (o *OAuthBackend) refreshToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
 	oauthToken := &oauth2.Token{RefreshToken: refreshToken}
-	tokenSource := o.oauth2Config.TokenSource(context.Background(), oauthToken)
+	tokenSource := o.oauth2Config.TokenSource(ctx, oauthToken)
 	return tokenSource.Token()
 }
 
-func (o *OAuthBackend) makeTokenResponse(token *oauth2.Token, err error, w http.ResponseWriter) {
+func (o *OAuthBackend) makeTokenResponse(token *oauth2.Token, err error, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	} else {
-		info, err := o.CheckAccessToken(token.AccessToken)
+		info, err := o.CheckAccessToken(r.Context(), token.AccessToken)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -230,18 +297,22 @@ func (o *OAuthBackend) makeTokenResponse(token *oauth2.Token, err error, w http.
 		w.Header().Add("Set-Cookie", "access_token="+token.AccessToken+"; Max-Age="+strconv.Itoa(info.ExpiresInSec)+"; Path="+o.RedirectBasePath+"; Secure; HttpOnly")
 		w.Header().Add("Set-Cookie", "refresh_token="+token.RefreshToken+"; Max-Age=31536000; Path="+o.RedirectBasePath+"; Secure; HttpOnly")
 		w.Header().Add("Set-Cookie", "email="+info.Email+"; Max-Age=31536000; Path="+o.RedirectBasePath+"; Secure; HttpOnly")
+		if o.confirmDevice(w, r, info.Email) {
+			return
+		}
 		w.Header().Add("Referrer-Policy", "no-referrer")
 		w.Header().Add("Content-Type", "text/html; charset=UTF-8")
-		clientToken := token.AccessToken
-		if token.RefreshToken != "" {
-			clientToken = "SR:" + token.RefreshToken
+		// the provider tokens stay with the server, client only gets the self-issued credential
+		credential, _, err := o.signer.Issue(info.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		encryptedClientToken := utils.EncryptToken(clientToken, o.config.AESSecret)
 
 		err = renderTemplate.Execute(w, map[string]any{
 			"Src":   o.config.RenderJsSrc,
 			"Email": info.Email,
-			"Token": encryptedClientToken,
+			"Token": credential,
 		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -266,14 +337,14 @@ func (o *OAuthBackend) handleRoot(w http.ResponseWriter, r *http.Request) {
 
 	refreshTokenCookie, err := r.Cookie("refresh_token")
 	if err == nil && strings.TrimSpace(refreshTokenCookie.Value) != "" {
-		newToken, err := o.refreshToken(refreshTokenCookie.Value)
-		o.makeTokenResponse(newToken, err, w)
+		newToken, err := o.refreshToken(r.Context(), refreshTokenCookie.Value)
+		o.makeTokenResponse(newToken, err, w, r)
 		return
 	}
 
 	accessTokenCookie, err := r.Cookie("access_token")
 	if err == nil {
-		o.makeTokenResponse(&oauth2.Token{AccessToken: accessTokenCookie.Value}, nil, w)
+		o.makeTokenResponse(&oauth2.Token{AccessToken: accessTokenCookie.Value}, nil, w, r)
 		return
 	}
 
@@ -281,7 +352,7 @@ func (o *OAuthBackend) handleRoot(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		w.Header().Add("Set-Cookie", "code=; Max-Age=-1; Path="+o.RedirectBasePath+"; Secure; HttpOnly")
 		newToken, err := o.oauth2Config.Exchange(r.Context(), codeCookie.Value)
-		o.makeTokenResponse(newToken, err, w)
+		o.makeTokenResponse(newToken, err, w, r)
 		return
 	}
 
@@ -298,7 +369,29 @@ func (o *OAuthBackend) handleRoot(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusFound)
 }
 
-// API for client to refresh the access token
+// isCredentialRevoked reports if the credential is revoked by its user, fingerprint or issue time
+func (o *OAuthBackend) isCredentialRevoked(credential string, claims *CredentialClaims) bool {
+	return o.Revocations.IsEmailRevoked(claims.Email) ||
+		o.Revocations.IsTokenRevoked(credential) ||
+		o.Revocations.IsIssuedBeforeRevoked(time.Unix(claims.IssuedAt, 0))
+}
+
+// refreshCredential issues a new credential by the refresh credential
+func (o *OAuthBackend) refreshCredential(refreshCredential string) (string, *CredentialClaims, error) {
+	claims, err := o.signer.VerifyRefresh(refreshCredential)
+	if err != nil {
+		return "", nil, err
+	}
+	if o.isCredentialRevoked(refreshCredential, claims) {
+		return "", nil, errors.New("refresh credential is revoked")
+	}
+	if !o.validEmailRegexp.MatchString(claims.Email) {
+		return "", nil, errors.New("your email is not allowed")
+	}
+	return o.signer.Issue(claims.Email)
+}
+
+// API for client to refresh the access token, or to get a new credential by the refresh credential
 func (o *OAuthBackend) handleRefresh(w http.ResponseWriter, r *http.Request) {
 	input := &RefreshTokenInfo{}
 	dec := json.NewDecoder(r.Body)
@@ -307,7 +400,16 @@ func (o *OAuthBackend) handleRefresh(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	newToken, err := o.refreshToken(input.RefreshToken)
+	if IsCredential(input.RefreshToken) {
+		credential, claims, err := o.refreshCredential(input.RefreshToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		makeJSONResponse(w, &AccessTokenInfo{credential, int(claims.ExpiresAt - time.Now().Unix())})
+		return
+	}
+	newToken, err := o.refreshToken(r.Context(), input.RefreshToken)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -325,7 +427,20 @@ func (o *OAuthBackend) handleTokenInfo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	info, err := o.CheckAccessToken(input.AccessToken)
+	if IsCredential(input.AccessToken) {
+		claims, err := o.signer.Verify(input.AccessToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if o.isCredentialRevoked(input.AccessToken, claims) {
+			http.Error(w, "credential is revoked", http.StatusBadRequest)
+			return
+		}
+		makeJSONResponse(w, &AccessTokenInfo{input.AccessToken, int(claims.ExpiresAt - time.Now().Unix())})
+		return
+	}
+	info, err := o.CheckAccessToken(r.Context(), input.AccessToken)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
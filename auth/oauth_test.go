@@ -13,7 +13,7 @@ func TestOAuthBackendInit(t *testing.T) {
 	cfg := &Config{
 		OAuth: struct {
 			ClientID     string   `yaml:"client_id"`
-			ClientSecret string   `yaml:"client_secret"`
+			ClientSecret string   `yaml:"client_secret" redact:"secret"`
 			Endpoint     struct {
 				AuthURL   string           `yaml:"auth_url"`
 				TokenURL  string           `yaml:"token_url"`
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Revocation of users and tokens
+//
+// The list is persisted as JSON, so it can be changed by the server itself or by
+// the CLI of another process; the server picks up the changes by Reload.
+
+type revocationData struct {
+	// Emails are the locked out users and when they were locked out
+	Emails map[string]time.Time `json:"emails"`
+	// Fingerprints are the revoked tokens, see TokenFingerprint
+	Fingerprints map[string]time.Time `json:"fingerprints"`
+	// IssuedBefore revokes all the tokens issued before it
+	IssuedBefore time.Time `json:"issued_before"`
+}
+
+// RevocationList the revoked users and tokens, a nil list revokes nothing
+type RevocationList struct {
+	path   string
+	l      sync.RWMutex
+	data   revocationData
+	digest [sha256.Size]byte
+}
+
+// TokenFingerprint identifies a token without keeping it
+func TokenFingerprint(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:16])
+}
+
+// NewRevocationList a RevocationList persisted in path, it is loaded if the file exists
+func NewRevocationList(path string) (*RevocationList, error) {
+	r := &RevocationList{path: path}
+	r.data.init()
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (d *revocationData) init() {
+	if d.Emails == nil {
+		d.Emails = make(map[string]time.Time)
+	}
+	if d.Fingerprints == nil {
+		d.Fingerprints = make(map[string]time.Time)
+	}
+}
+
+// Reload the list if the file is changed on disk
+func (r *RevocationList) Reload() (bool, error) {
+	content, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256(content)
+	r.l.RLock()
+	unchanged := digest == r.digest
+	r.l.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data := revocationData{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return false, err
+	}
+	data.init()
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.data = data
+	r.digest = digest
+	return true, nil
+}
+
+// save must be called with the write lock held
+func (r *RevocationList) save() error {
+	content, err := json.MarshalIndent(&r.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".revocation-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+	r.digest = sha256.Sum256(content)
+	return nil
+}
+
+func (r *RevocationList) update(f func(d *revocationData)) error {
+	// do not override the changes made by others
+	if _, err := r.Reload(); err != nil {
+		return err
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	f(&r.data)
+	return r.save()
+}
+
+// RevokeEmail locks out the user, no matter how it is authenticated
+func (r *RevocationList) RevokeEmail(email string) error {
+	return r.update(func(d *revocationData) {
+		d.Emails[email] = time.Now()
+	})
+}
+
+// RestoreEmail lifts the lockout of the user
+func (r *RevocationList) RestoreEmail(email string) error {
+	return r.update(func(d *revocationData) {
+		delete(d.Emails, email)
+	})
+}
+
+// RevokeFingerprint revokes a single token by its fingerprint
+func (r *RevocationList) RevokeFingerprint(fingerprint string) error {
+	return r.update(func(d *revocationData) {
+		d.Fingerprints[fingerprint] = time.Now()
+	})
+}
+
+// RevokeIssuedBefore revokes all the tokens issued before t
+func (r *RevocationList) RevokeIssuedBefore(t time.Time) error {
+	return r.update(func(d *revocationData) {
+		d.IssuedBefore = t
+	})
+}
+
+// IsEmailRevoked reports if the user is locked out
+func (r *RevocationList) IsEmailRevoked(email string) bool {
+	if r == nil {
+		return false
+	}
+	r.l.RLock()
+	defer r.l.RUnlock()
+	_, ok := r.data.Emails[email]
+	return ok
+}
+
+// IsTokenRevoked reports if the token is revoked by its fingerprint
+func (r *RevocationList) IsTokenRevoked(token string) bool {
+	if r == nil {
+		return false
+	}
+	return r.IsFingerprintRevoked(TokenFingerprint(token))
+}
+
+// IsFingerprintRevoked reports if the token of the fingerprint is revoked
+func (r *RevocationList) IsFingerprintRevoked(fingerprint string) bool {
+	if r == nil {
+		return false
+	}
+	r.l.RLock()
+	defer r.l.RUnlock()
+	_, ok := r.data.Fingerprints[fingerprint]
+	return ok
+}
+
+// IsIssuedBeforeRevoked reports if a token issued at issuedAt is revoked,
+// tokens without issue time should pass the zero time.
+func (r *RevocationList) IsIssuedBeforeRevoked(issuedAt time.Time) bool {
+	if r == nil {
+		return false
+	}
+	r.l.RLock()
+	defer r.l.RUnlock()
+	return !r.data.IssuedBefore.IsZero() && issuedAt.Before(r.data.IssuedBefore)
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocation.json")
+	revocations, err := NewRevocationList(path)
+	assert.NoError(t, err)
+
+	assert.False(t, revocations.IsEmailRevoked("user@example.com"))
+	assert.False(t, revocations.IsTokenRevoked("some-token"))
+	assert.False(t, revocations.IsIssuedBeforeRevoked(time.Time{}))
+
+	assert.NoError(t, revocations.RevokeEmail("user@example.com"))
+	assert.NoError(t, revocations.RevokeFingerprint(TokenFingerprint("some-token")))
+	cutoff := time.Now()
+	assert.NoError(t, revocations.RevokeIssuedBefore(cutoff))
+
+	assert.True(t, revocations.IsEmailRevoked("user@example.com"))
+	assert.False(t, revocations.IsEmailRevoked("other@example.com"))
+	assert.True(t, revocations.IsTokenRevoked("some-token"))
+	assert.False(t, revocations.IsTokenRevoked("other-token"))
+	assert.True(t, revocations.IsIssuedBeforeRevoked(cutoff.Add(-time.Minute)))
+	assert.False(t, revocations.IsIssuedBeforeRevoked(cutoff.Add(time.Minute)))
+
+	// persisted on disk
+	loaded, err := NewRevocationList(path)
+	assert.NoError(t, err)
+	assert.True(t, loaded.IsEmailRevoked("user@example.com"))
+	assert.True(t, loaded.IsTokenRevoked("some-token"))
+
+	// changes of another process are picked up by reload
+	assert.NoError(t, loaded.RestoreEmail("user@example.com"))
+	changed, err := revocations.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, revocations.IsEmailRevoked("user@example.com"))
+
+	// nil list revokes nothing
+	var empty *RevocationList
+	assert.False(t, empty.IsEmailRevoked("user@example.com"))
+	assert.False(t, empty.IsTokenRevoked("some-token"))
+	assert.False(t, empty.IsIssuedBeforeRevoked(time.Time{}))
+}
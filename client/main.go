@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,13 +15,20 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/winguse/go-shp/auth"
 	"github.com/winguse/go-shp/utils"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var activeConnCount int32
@@ -26,7 +36,9 @@ var activeRemote2Local int32
 var activeLocal2Remote int32
 
 var logger = utils.NewLogger(utils.InfoLevel)
+var tracing = (*utils.Tracing)(nil) // nil disables tracing
 var configFilePath = flag.String("config", "./config.yaml", "the config file path.")
+var login = flag.Bool("login", false, "log in by device authorization, save the credential and exit.")
 
 // ProxySelectPolicy the policy to select proxy
 type ProxySelectPolicy string
@@ -54,6 +66,8 @@ type Proxy struct {
 	Name         string            `yaml:"name"`
 	Hosts        []string          `yaml:"hosts,omitempty"`
 	SelectPolicy ProxySelectPolicy `yaml:"select_policy,omitempty"` // RANDOM / LATENCY
+	CertFile     string            `yaml:"cert_file,omitempty"`     // client certificate to authenticate to the hosts
+	KeyFile      string            `yaml:"key_file,omitempty"`
 	activeHosts  []string
 	latencyMap   map[string]time.Duration
 }
@@ -82,11 +96,62 @@ type UnmatchedPolicy struct {
 type Config struct {
 	Username        string          `yaml:"username"`
 	Token           string          `yaml:"token"`
+	TokenFile       string          `yaml:"token_file"`    // the credential saved by -login, overrides username / token, default token.json next to the config
+	RefreshToken    string          `yaml:"refresh_token"` // to renew the token before it expires
 	AuthBasePath    string          `yaml:"auth_base_path"`
 	ListenPort      int             `yaml:"listen_port"`
 	Proxies         []*Proxy        `yaml:"proxies"`
 	Rules           []*Rule         `yaml:"rules"`
 	UnmatchedPolicy UnmatchedPolicy `yaml:"unmatched_policy"`
+
+	// Timeouts of the local connections, disabled if zero
+	Timeouts utils.TimeoutConfig `yaml:"timeouts"`
+	// Tracing exports the spans of the tunnels, disabled if not configured
+	Tracing *utils.TracingConfig `yaml:"tracing"`
+}
+
+// TokenFile the credential saved by login
+type TokenFile struct {
+	Username     string `json:"username"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// defaultTokenFile of the credential, in the directory of the config file
+const defaultTokenFile = "token.json"
+
+// loadTokenFile overrides the username / token of config by the token file if it exists,
+// the token file defaults to token.json next to the config file at configPath
+func loadTokenFile(configPath string, config *Config) error {
+	if config.TokenFile == "" {
+		config.TokenFile = filepath.Join(filepath.Dir(configPath), defaultTokenFile)
+	}
+	content, err := os.ReadFile(config.TokenFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tokenFile := &TokenFile{}
+	if err := json.Unmarshal(content, tokenFile); err != nil {
+		return err
+	}
+	config.Username = tokenFile.Username
+	config.Token = tokenFile.Token
+	if tokenFile.RefreshToken != "" {
+		config.RefreshToken = tokenFile.RefreshToken
+	}
+	return nil
+}
+
+// saveCredential to the token file, the config file is never rewritten
+func saveCredential(config *Config) error {
+	content, err := json.MarshalIndent(&TokenFile{config.Username, config.Token, config.RefreshToken}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.TokenFile, content, 0600)
 }
 
 // ----
@@ -139,14 +204,121 @@ func (h *h2Proxy) Close() error {
 type shpClient struct {
 	config               *Config
 	h2Transport          *http.Transport
-	client               *http.Client
+	proxyTransports      map[string]*http.Transport // by proxy name
 	h1Transport          *http.Transport
 	proxyMap             map[string]*Proxy
 	detectionFailDomains map[string]time.Time
+	tokenLock            sync.RWMutex // guards config.Token and tokenExpiry
+	tokenExpiry          time.Time
+	refreshLock          sync.Mutex
+}
+
+// proxyRoute a host of the proxy selected, the zero value dials directly
+type proxyRoute struct {
+	name string
+	host string
 }
 
-func (s *shpClient) getBasicAuthToken() string {
-	return "Basic " + base64.StdEncoding.EncodeToString([]byte(s.config.Username+":"+s.config.Token))
+// transport to the host of route, it carries the client certificate of the proxy if configured
+func (s *shpClient) transport(route proxyRoute) *http.Transport {
+	if transport, ok := s.proxyTransports[route.name]; ok {
+		return transport
+	}
+	return s.h2Transport
+}
+
+func (s *shpClient) setProxyAuthorization(header http.Header) {
+	token := s.currentToken()
+	if s.config.Username == "" && token == "" {
+		return // authenticated by client certificate only
+	}
+	header.Set("Proxy-Authorization", s.getBasicAuthToken(token))
+}
+
+func (s *shpClient) getBasicAuthToken(token string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(s.config.Username+":"+token))
+}
+
+// currentToken the token in use, it is replaced when refreshed
+func (s *shpClient) currentToken() string {
+	s.tokenLock.RLock()
+	defer s.tokenLock.RUnlock()
+	return s.config.Token
+}
+
+func (s *shpClient) setToken(token string, expiry time.Time) {
+	s.tokenLock.Lock()
+	defer s.tokenLock.Unlock()
+	s.config.Token = token
+	s.tokenExpiry = expiry
+}
+
+// authRoute the proxy host to call the APIs of auth backend
+func (s *shpClient) authRoute() proxyRoute {
+	for _, proxy := range s.config.Proxies {
+		if len(proxy.activeHosts) > 0 {
+			return proxyRoute{proxy.Name, proxy.activeHosts[0]}
+		}
+		if len(proxy.Hosts) > 0 {
+			return proxyRoute{proxy.Name, proxy.Hosts[0]}
+		}
+	}
+	return proxyRoute{}
+}
+
+// refreshToken renews the token by the refresh token. stale is the token used, if it
+// has been replaced by others in the meanwhile, it is not refreshed again.
+func (s *shpClient) refreshToken(route proxyRoute, stale string) error {
+	if s.config.RefreshToken == "" {
+		return errors.New("refresh token is not configured")
+	}
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+	if s.currentToken() != stale {
+		return nil
+	}
+	info := &auth.AccessTokenInfo{}
+	statusCode, err := s.callAuthAPI(route, "refresh", &auth.RefreshTokenInfo{RefreshToken: s.config.RefreshToken}, info)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusOK || info.AccessToken == "" {
+		return fmt.Errorf("refresh returned %d", statusCode)
+	}
+	s.setToken(info.AccessToken, time.Now().Add(time.Duration(info.ExpiresInSec)*time.Second))
+	logger.Info("Token refreshed, expires in %d seconds.\n", info.ExpiresInSec)
+	s.tokenLock.RLock()
+	defer s.tokenLock.RUnlock()
+	return saveCredential(s.config)
+}
+
+// keepTokenFresh refreshes the token before it expires
+func (s *shpClient) keepTokenFresh() {
+	if s.config.RefreshToken == "" {
+		return
+	}
+	// learn when the current token expires
+	if token := s.currentToken(); token != "" {
+		info := &auth.AccessTokenInfo{}
+		statusCode, err := s.callAuthAPI(s.authRoute(), "token-info", &auth.AccessTokenInfo{AccessToken: token}, info)
+		if err == nil && statusCode == http.StatusOK {
+			s.setToken(token, time.Now().Add(time.Duration(info.ExpiresInSec)*time.Second))
+		}
+	}
+	for {
+		s.tokenLock.RLock()
+		remaining := time.Until(s.tokenExpiry)
+		s.tokenLock.RUnlock()
+		// refresh when 10% of the lifetime is left, but at least a minute ahead
+		wait := remaining - max(remaining/10, time.Minute)
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		if err := s.refreshToken(s.authRoute(), s.currentToken()); err != nil {
+			logger.Error("Failed to refresh token: %s\n", err)
+			time.Sleep(time.Minute)
+		}
+	}
 }
 
 func genPossibleSearches(domain string) []string {
@@ -205,7 +377,7 @@ func (s *shpClient) addDetectionFailDomain(domain string) {
 	s.detectionFailDomains = newMap
 }
 
-func (s *shpClient) getPolicy(domain string) (string, bool) {
+func (s *shpClient) getPolicy(domain string) (proxyRoute, bool) {
 	searches := genPossibleSearches(domain)
 	proxyName, detect := s.findProxyName(searches)
 
@@ -214,7 +386,7 @@ func (s *shpClient) getPolicy(domain string) (string, bool) {
 	}
 
 	if proxyName == DirectProxyName {
-		return "", detect
+		return proxyRoute{}, detect
 	}
 
 	proxy := s.proxyMap[proxyName]
@@ -234,23 +406,25 @@ func (s *shpClient) getPolicy(domain string) (string, bool) {
 			}
 		}
 		selectedHost := activeHosts[rand.Int()%similarCount]
-		return selectedHost, detect
+		return proxyRoute{proxyName, selectedHost}, detect
 	}
 	if proxy.SelectPolicy == ProxySelectPolicyLatency {
-		return activeHosts[0], detect
+		return proxyRoute{proxyName, activeHosts[0]}, detect
 	}
 	selectedHost := activeHosts[rand.Int()%length]
-	return selectedHost, detect
+	return proxyRoute{proxyName, selectedHost}, detect
 }
 
-func (s *shpClient) handleHTTP(responseWriter http.ResponseWriter, originalReq *http.Request, proxyHost string, detect bool) {
+func (s *shpClient) handleHTTP(responseWriter http.ResponseWriter, originalReq *http.Request, route proxyRoute, detect bool) {
+	// the proxy headers sent by the browser are for us
+	utils.RemoveHopByHopHeaders(originalReq.Header)
 	// to keep HTTP request idempotent, if we need to send two request, direct HTTP is first
 
-	if proxyHost != "" && detect { // will send two request
+	if route.host != "" && detect { // will send two request
 		detectReq, _ := http.NewRequest("GET", "https://"+originalReq.Host+"/favicon.ico", nil)
 		_, err := s.h1Transport.RoundTrip(detectReq)
 		if err == nil { // direct conn is OK, then skip using proxy
-			proxyHost = ""
+			route = proxyRoute{}
 		} else {
 			s.addDetectionFailDomain(originalReq.Host)
 		}
@@ -259,16 +433,25 @@ func (s *shpClient) handleHTTP(responseWriter http.ResponseWriter, originalReq *
 	resp := (*http.Response)(nil)
 	respErr := error(nil)
 
-	if proxyHost == "" {
+	if route.host == "" {
 		logger.Info("%s via: DIRECT\n", originalReq.Host)
 		resp, respErr = s.h1Transport.RoundTrip(originalReq)
 	} else {
-		logger.Info("%s via: PROXY %s\n", originalReq.Host, proxyHost)
+		logger.Info("%s via: PROXY %s\n", originalReq.Host, route.host)
 		originalReq.URL.Scheme = "https"
-		originalReq.URL.Host = proxyHost
+		originalReq.URL.Host = route.host
 		originalReq.Close = false
-		originalReq.Header.Add("Proxy-Authorization", s.getBasicAuthToken())
-		resp, respErr = s.h2Transport.RoundTrip(originalReq)
+		token := s.currentToken()
+		s.setProxyAuthorization(originalReq.Header)
+		resp, respErr = s.transport(route).RoundTrip(originalReq)
+		// retry once with a fresh token, if the request can be sent again
+		if respErr == nil && resp.StatusCode == http.StatusProxyAuthRequired &&
+			(originalReq.Body == nil || originalReq.Body == http.NoBody) &&
+			s.refreshToken(route, token) == nil {
+			resp.Body.Close()
+			s.setProxyAuthorization(originalReq.Header)
+			resp, respErr = s.transport(route).RoundTrip(originalReq)
+		}
 	}
 
 	if respErr != nil {
@@ -278,6 +461,9 @@ func (s *shpClient) handleHTTP(responseWriter http.ResponseWriter, originalReq *
 	}
 
 	defer resp.Body.Close()
+	watchdog := utils.NewWatchdog(s.config.Timeouts, func() { resp.Body.Close() })
+	defer logTimeout(originalReq.Host, watchdog)
+	utils.RemoveHopByHopHeaders(resp.Header)
 	for k, vv := range resp.Header {
 		for _, v := range vv {
 			responseWriter.Header().Add(k, v)
@@ -287,41 +473,63 @@ func (s *shpClient) handleHTTP(responseWriter http.ResponseWriter, originalReq *
 	if fl, ok := responseWriter.(http.Flusher); ok {
 		fl.Flush()
 	}
-	utils.CopyAndPrintError(responseWriter, resp.Body, logger)
+	utils.CopyAndPrintError(watchdog.Writer(responseWriter), resp.Body, logger)
+}
+
+// logTimeout stops the watchdog and logs if it fired
+func logTimeout(host string, watchdog *utils.Watchdog) {
+	watchdog.Stop()
+	if reason := watchdog.Reason(); reason != "" {
+		logger.Debug("%s closed by %s\n", host, reason)
+	}
+}
+
+func (s *shpClient) buildTunnel(ctx context.Context, host string, route proxyRoute) (remoteConn, error) {
+	ctx, span := utils.StartSpan(ctx, "build_tunnel", attribute.String("shp.proxy", route.host))
+	token := s.currentToken()
+	conn, statusCode, err := s.connectTunnel(ctx, host, route)
+	// retry once with a fresh token
+	if statusCode == http.StatusProxyAuthRequired && s.refreshToken(route, token) == nil {
+		conn, _, err = s.connectTunnel(ctx, host, route)
+	}
+	utils.EndSpan(span, err)
+	return conn, err
 }
 
-func (s *shpClient) buildTunnel(host string, proxyHost string) (remoteConn, error) {
+func (s *shpClient) connectTunnel(ctx context.Context, host string, route proxyRoute) (remoteConn, int, error) {
 	pr, pw := io.Pipe()
 	request := http.Request{
 		Method: http.MethodConnect,
 		URL: &url.URL{
 			Scheme: "https",
-			Host:   proxyHost,
+			Host:   route.host,
 		},
-		Header: map[string][]string{
-			"Proxy-Authorization": []string{s.getBasicAuthToken()},
-		},
-		Host: host,
-		Body: pr,
+		Header: make(http.Header),
+		Host:   host,
+		Body:   pr,
 	}
+	s.setProxyAuthorization(request.Header)
 
-	response, err := s.client.Do(&request)
+	response, err := s.transport(route).RoundTrip(request.WithContext(tracing.WithClientTrace(ctx)))
 
 	if err != nil {
 		logger.Error("error when sending request %s\n", err)
-		return nil, err
+		return nil, 0, err
 	}
 	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
 		errMsg := fmt.Sprintf("Expected status OK, but %d\n", response.StatusCode)
 		logger.Error("%s", errMsg)
-		return nil, errors.New(errMsg)
+		return nil, response.StatusCode, errors.New(errMsg)
 	}
 
-	return &h2Proxy{response.Body, pw}, nil
+	return &h2Proxy{response.Body, pw}, response.StatusCode, nil
 }
 
-func createTCPConn(host string) (*net.TCPConn, error) {
-	destConn, err := net.DialTimeout("tcp", host, 10*time.Second)
+func createTCPConn(ctx context.Context, host string) (*net.TCPConn, error) {
+	ctx, span := utils.StartSpan(ctx, "dial")
+	destConn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(tracing.WithClientTrace(ctx), "tcp", host)
+	utils.EndSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -331,7 +539,7 @@ func createTCPConn(host string) (*net.TCPConn, error) {
 	return nil, errors.New("failed to cast net.Conn to net.TCPConn")
 }
 
-func (s *shpClient) handleTunneling(responseWriter http.ResponseWriter, req *http.Request, proxyHost string, detect bool) {
+func (s *shpClient) handleTunneling(responseWriter http.ResponseWriter, req *http.Request, route proxyRoute, detect bool) {
 	openConnCh := make(chan *connCreation)
 	writeConnCh := make(chan *connCreation)
 	connOpenAttemptCount := 0
@@ -340,12 +548,15 @@ func (s *shpClient) handleTunneling(responseWriter http.ResponseWriter, req *htt
 	connOpenSuccess := (*connCreation)(nil)
 	connWriteAttemptCount := 0
 	connWriteAttemptReturnedCount := 0
+	// the tunnels outlive the request of the hijacked connection
+	ctx, span := utils.StartSpan(context.Background(), "tunnel", tracing.Destination(req.Host))
+	defer span.End()
 
-	if proxyHost == "" || detect {
+	if route.host == "" || detect {
 		connOpenAttemptCount++
 		// init direct
 		go func() {
-			conn, err := createTCPConn(req.Host)
+			conn, err := createTCPConn(ctx, req.Host)
 			if detect && err != nil {
 				s.addDetectionFailDomain(req.Host)
 			}
@@ -356,14 +567,14 @@ func (s *shpClient) handleTunneling(responseWriter http.ResponseWriter, req *htt
 		}()
 	}
 
-	if proxyHost != "" {
+	if route.host != "" {
 		connOpenAttemptCount++
 		// init proxy
 		go func() {
 			if detect {
 				time.Sleep(time.Duration(s.config.UnmatchedPolicy.DetectDelayMs) * time.Millisecond) // sleep proxy on detect as we prefer direct
 			}
-			conn, err := s.buildTunnel(req.Host, proxyHost)
+			conn, err := s.buildTunnel(ctx, req.Host, route)
 			result := &connCreation{
 				conn, err, "PROXY",
 			}
@@ -464,54 +675,179 @@ func (s *shpClient) handleTunneling(responseWriter http.ResponseWriter, req *htt
 		return
 	}
 
-	logger.Debug("%s via: %s %s\n", req.Host, successCreation.via, proxyHost)
+	logger.Debug("%s via: %s %s\n", req.Host, successCreation.via, route.host)
+	span.SetAttributes(attribute.String("shp.via", successCreation.via))
 	remoteConn := successCreation.conn
+	remoteReader := utils.FirstByteReader(ctx, remoteConn)
+	watchdog := utils.NewWatchdog(s.config.Timeouts, func() {
+		localConn.Close()
+		remoteConn.Close()
+	})
+	defer logTimeout(req.Host, watchdog)
 	go func() {
 		atomic.AddInt32(&activeLocal2Remote, 1)
 		defer atomic.AddInt32(&activeLocal2Remote, -1)
 		// local -> remote
 		defer remoteConn.CloseWrite()
-		utils.CopyAndPrintError(remoteConn, localConn, logger)
+		utils.CopyAndPrintError(watchdog.Writer(remoteConn), localConn, logger)
 	}()
 	atomic.AddInt32(&activeRemote2Local, 1)
 	defer atomic.AddInt32(&activeRemote2Local, -1)
 	// remote -> local
 	defer remoteConn.CloseRead()
-	utils.CopyAndPrintError(localConn, remoteConn, logger)
+	utils.CopyAndPrintError(watchdog.Writer(localConn), remoteReader, logger)
+}
+
+// handleUpgrade sends the handshake of switching protocols (e.g. WebSocket) through a tunnel,
+// as Upgrade can not be sent over HTTP/2, then streams both directions
+func (s *shpClient) handleUpgrade(responseWriter http.ResponseWriter, req *http.Request, route proxyRoute) {
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	conn, err := remoteConn(nil), error(nil)
+	if route.host == "" {
+		logger.Info("%s via: DIRECT\n", host)
+		tcpConn, dialErr := createTCPConn(context.Background(), host)
+		conn, err = tcpConn, dialErr
+	} else {
+		logger.Info("%s via: PROXY %s\n", host, route.host)
+		conn, err = s.buildTunnel(context.Background(), host, route)
+	}
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	if err := req.Write(conn); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	localConn, bufrw, err := responseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Fatal("Failed to Hijack") // usually will not go here
+	}
+	defer localConn.Close()
+	watchdog := utils.NewWatchdog(s.config.Timeouts, func() {
+		localConn.Close()
+		conn.Close()
+	})
+	defer logTimeout(host, watchdog)
+	reader := io.Reader(localConn)
+	if bufrw.Reader.Buffered() > 0 {
+		reader = io.MultiReader(bufrw.Reader, localConn)
+	}
+	go func() {
+		// local -> remote
+		defer conn.CloseWrite()
+		utils.CopyAndPrintError(watchdog.Writer(conn), reader, logger)
+	}()
+	// remote -> local
+	defer conn.CloseRead()
+	utils.CopyAndPrintError(watchdog.Writer(localConn), conn, logger)
 }
 
 func (s *shpClient) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	atomic.AddInt32(&activeConnCount, 1)
 	defer atomic.AddInt32(&activeConnCount, -1)
 
-	host, detect := s.getPolicy(req.URL.Hostname())
+	route, detect := s.getPolicy(req.URL.Hostname())
 
 	if req.Method == http.MethodConnect {
-		s.handleTunneling(rw, req, host, detect)
+		s.handleTunneling(rw, req, route, detect)
+	} else if httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade") {
+		s.handleUpgrade(rw, req, route)
 	} else {
-		s.handleHTTP(rw, req, host, detect)
+		s.handleHTTP(rw, req, route, detect)
+	}
+}
+
+// callAuthAPI posts input as JSON to the API of the auth backend on the host of route, and decodes the output
+func (s *shpClient) callAuthAPI(route proxyRoute, api string, input any, output any) (int, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+route.host+s.config.AuthBasePath+api, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Transport: s.transport(route), Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(output); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s returned %s", api, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deviceLogin logs in by device authorization through the first proxy host
+func (s *shpClient) deviceLogin() error {
+	if len(s.config.Proxies) == 0 || len(s.config.Proxies[0].Hosts) == 0 {
+		return errors.New("no proxy host to log in")
+	}
+	route := proxyRoute{s.config.Proxies[0].Name, s.config.Proxies[0].Hosts[0]}
+
+	code := &auth.DeviceCodeResponse{}
+	if _, err := s.callAuthAPI(route, "device/code", struct{}{}, code); err != nil {
+		return err
+	}
+	fmt.Printf("Open %s in your browser and enter the code: %s\n", code.VerificationURI, code.UserCode)
+
+	interval := time.Duration(code.IntervalSec) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresInSec) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token := &auth.DeviceTokenResponse{}
+		_, err := s.callAuthAPI(route, "device/token", &auth.DeviceTokenRequest{DeviceCode: code.DeviceCode}, token)
+		if err != nil {
+			logger.Error("poll device token failed: %s\n", err)
+			continue
+		}
+		switch token.Error {
+		case "":
+			s.config.Username = token.Email
+			s.config.Token = token.Token
+			s.config.RefreshToken = token.RefreshToken
+			fmt.Printf("Logged in as %s.\n", token.Email)
+			return nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return errors.New("device login failed: " + token.Error)
+		}
 	}
+	return errors.New("device login expired")
 }
 
 func (s *shpClient) checkProxies() {
 	latencyTest := func() {
-		hostLatency := make(map[string]time.Duration)
+		// by proxy, as the proxies sharing a host may use different client certificates
+		hostLatency := make(map[proxyRoute]time.Duration)
 		for _, proxy := range s.config.Proxies {
 			for _, host := range proxy.Hosts {
-				hostLatency[host] = time.Hour
+				hostLatency[proxyRoute{proxy.Name, host}] = time.Hour
 			}
 		}
 
-		for host := range hostLatency {
+		for route := range hostLatency {
 			startTime := time.Now()
-			req, _ := http.NewRequest("GET", "https://"+host+s.config.AuthBasePath+"health", nil)
-			resp, err := s.h2Transport.RoundTrip(req)
+			req, _ := http.NewRequest("GET", "https://"+route.host+s.config.AuthBasePath+"health", nil)
+			resp, err := s.transport(route).RoundTrip(req)
 			if err != nil || resp.StatusCode != http.StatusOK {
-				hostLatency[host] = time.Hour
-				logger.Debug("%s time out or non-OK response.\n", host)
+				hostLatency[route] = time.Hour
+				logger.Debug("%s time out or non-OK response.\n", route.host)
 			} else {
-				hostLatency[host] = time.Since(startTime)
-				logger.Debug("%s latency %d ms %d.\n", host, hostLatency[host].Milliseconds(), resp.StatusCode)
+				hostLatency[route] = time.Since(startTime)
+				logger.Debug("%s latency %d ms %d.\n", route.host, hostLatency[route].Milliseconds(), resp.StatusCode)
 			}
 		}
 
@@ -519,14 +855,14 @@ func (s *shpClient) checkProxies() {
 			activeHosts := make([]string, 0)
 			latencyMap := make(map[string]time.Duration)
 			for _, host := range proxy.Hosts {
-				latencyMap[host] = hostLatency[host]
-				if hostLatency[host] == time.Hour {
+				latencyMap[host] = hostLatency[proxyRoute{proxy.Name, host}]
+				if latencyMap[host] == time.Hour {
 					continue
 				}
 				activeHosts = append(activeHosts, host)
 			}
 			sort.SliceStable(activeHosts, func(i, j int) bool {
-				return hostLatency[activeHosts[i]] < hostLatency[activeHosts[j]]
+				return latencyMap[activeHosts[i]] < latencyMap[activeHosts[j]]
 			})
 			proxy.activeHosts = activeHosts
 			proxy.latencyMap = latencyMap
@@ -538,6 +874,21 @@ func (s *shpClient) checkProxies() {
 	}
 }
 
+func newProxyTransport(responseHeaderTimeout time.Duration, certificates ...tls.Certificate) *http.Transport {
+	return &http.Transport{
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: certificates,
+		},
+		DialContext: (&net.Dialer{
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:      64,
+		ForceAttemptHTTP2: true,
+	}
+}
+
 func main() {
 	go func() {
 		for range time.Tick(time.Second) {
@@ -549,32 +900,32 @@ func main() {
 
 	config := &Config{}
 	utils.LoadConfigFile(*configFilePath, config)
+	if err := loadTokenFile(*configFilePath, config); err != nil {
+		log.Fatal("Failed to load token file: ", err)
+	}
+	if config.Tracing != nil {
+		var err error
+		if tracing, err = utils.NewTracing(*config.Tracing); err != nil {
+			log.Fatal("Failed to init tracing: ", err)
+		}
+		tracing.ShutdownOnSignal()
+	}
 
 	s := &shpClient{
 		config:               config,
 		proxyMap:             make(map[string]*Proxy),
+		proxyTransports:      make(map[string]*http.Transport),
 		detectionFailDomains: make(map[string]time.Time),
 	}
-	s.h2Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
-		DialContext: (&net.Dialer{
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:      64,
-		ForceAttemptHTTP2: true,
-	}
-	s.client = &http.Client{
-		Transport: s.h2Transport,
-	}
+	s.h2Transport = newProxyTransport(config.Timeouts.ResponseHeader)
 	s.h1Transport = &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   10 * time.Second,
 			DualStack: true,
 		}).DialContext,
-		MaxIdleConns:      64,
-		ForceAttemptHTTP2: false,
+		MaxIdleConns:          64,
+		ForceAttemptHTTP2:     false,
+		ResponseHeaderTimeout: config.Timeouts.ResponseHeader,
 	}
 	for _, rule := range config.Rules {
 		rule.domainSet = make(map[string]bool)
@@ -584,14 +935,37 @@ func main() {
 	}
 	for _, proxy := range config.Proxies {
 		s.proxyMap[proxy.Name] = proxy
+		if proxy.CertFile != "" && proxy.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(proxy.CertFile, proxy.KeyFile)
+			if err != nil {
+				log.Fatal("Failed to load client certificate of ", proxy.Name, ": ", err)
+			}
+			s.proxyTransports[proxy.Name] = newProxyTransport(config.Timeouts.ResponseHeader, cert)
+		}
+	}
+
+	if *login {
+		if err := s.deviceLogin(); err != nil {
+			log.Fatal(err)
+		}
+		if err := saveCredential(config); err != nil {
+			log.Fatal("Failed to save credential: ", err)
+		}
+		logger.Info("Credential saved to %s .\n", config.TokenFile)
+		return
 	}
 
 	server := &http.Server{
-		Addr:    "127.0.0.1:" + strconv.Itoa(s.config.ListenPort),
-		Handler: s,
+		Handler:           s,
+		ReadHeaderTimeout: config.Timeouts.RequestHeader,
+	}
+	ln, err := (&net.ListenConfig{KeepAlive: config.Timeouts.KeepAlive}).Listen(context.Background(), "tcp", "127.0.0.1:"+strconv.Itoa(s.config.ListenPort))
+	if err != nil {
+		log.Fatal("Failed to listen: ", err)
 	}
 
 	go s.checkProxies()
+	go s.keepTokenFresh()
 	logger.Info("Local proxy starts listening %d\n", s.config.ListenPort)
-	server.ListenAndServe()
+	tracing.Fatal("Failed to serve: ", server.Serve(ln))
 }
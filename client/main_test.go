@@ -1,10 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/winguse/go-shp/auth"
 	"github.com/winguse/go-shp/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -45,6 +57,109 @@ rules:
 	assert.Contains(t, config.Rules[0].Domains, "google.com")
 }
 
+func TestSaveCredential(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	configContent := []byte("# the comments are kept\nusername: old\nlisten_port: 8080\n")
+	assert.NoError(t, os.WriteFile(configPath, configContent, 0600))
+
+	// saved to token file
+	config := &Config{Username: "user@example.com", Token: "c1.token", TokenFile: filepath.Join(dir, "token-file.json")}
+	assert.NoError(t, saveCredential(config))
+	loaded := &Config{TokenFile: config.TokenFile}
+	assert.NoError(t, loadTokenFile(configPath, loaded))
+	assert.Equal(t, "user@example.com", loaded.Username)
+	assert.Equal(t, "c1.token", loaded.Token)
+
+	// saved to token.json next to the config file by default, the config file is kept as is
+	loaded = &Config{Username: "old"}
+	assert.NoError(t, loadTokenFile(configPath, loaded))
+	assert.Equal(t, filepath.Join(dir, "token.json"), loaded.TokenFile)
+	assert.Equal(t, "old", loaded.Username)
+	loaded.Username, loaded.Token = "user@example.com", "c1.token"
+	assert.NoError(t, saveCredential(loaded))
+	loaded = &Config{}
+	utils.LoadConfigFile(configPath, loaded)
+	assert.NoError(t, loadTokenFile(configPath, loaded))
+	assert.Equal(t, "user@example.com", loaded.Username)
+	assert.Equal(t, "c1.token", loaded.Token)
+	assert.Equal(t, 8080, loaded.ListenPort)
+	content, err := os.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, configContent, content)
+
+	// missing token file is ignored
+	loaded = &Config{Username: "keep", TokenFile: filepath.Join(dir, "missing.json")}
+	assert.NoError(t, loadTokenFile(configPath, loaded))
+	assert.Equal(t, "keep", loaded.Username)
+}
+
+func TestRefreshToken(t *testing.T) {
+	calls := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		input := &auth.RefreshTokenInfo{}
+		json.NewDecoder(r.Body).Decode(input)
+		assert.Equal(t, "/auth/refresh", r.URL.Path)
+		assert.Equal(t, "c1.refresh", input.RefreshToken)
+		json.NewEncoder(w).Encode(&auth.AccessTokenInfo{AccessToken: "c1.new", ExpiresInSec: 3600})
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	s := &shpClient{
+		config: &Config{
+			AuthBasePath: "/auth/",
+			Username:     "user@example.com",
+			Token:        "c1.old",
+			RefreshToken: "c1.refresh",
+			TokenFile:    tokenFile,
+		},
+		h2Transport: server.Client().Transport.(*http.Transport),
+	}
+	route := proxyRoute{"proxy", server.Listener.Addr().String()}
+
+	assert.NoError(t, s.refreshToken(route, "c1.old"))
+	assert.Equal(t, "c1.new", s.currentToken())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), s.tokenExpiry, time.Minute)
+	loaded := &Config{TokenFile: tokenFile}
+	assert.NoError(t, loadTokenFile("", loaded))
+	assert.Equal(t, "c1.new", loaded.Token)
+	assert.Equal(t, "c1.refresh", loaded.RefreshToken)
+
+	// already refreshed by others
+	assert.NoError(t, s.refreshToken(route, "c1.old"))
+	assert.Equal(t, 1, calls)
+}
+
+func TestProxyTransportByName(t *testing.T) {
+	work := &Proxy{Name: "work", Hosts: []string{"shared.example.com"}}
+	home := &Proxy{Name: "home", Hosts: []string{"shared.example.com"}}
+	s := &shpClient{
+		config: &Config{
+			Rules: []*Rule{
+				{ProxyName: "work", domainSet: map[string]bool{"work.com": true}},
+				{ProxyName: "home", domainSet: map[string]bool{"home.com": true}},
+			},
+			UnmatchedPolicy: UnmatchedPolicy{ProxyName: DirectProxyName},
+		},
+		proxyMap:    map[string]*Proxy{"work": work, "home": home},
+		h2Transport: newProxyTransport(0),
+		proxyTransports: map[string]*http.Transport{
+			"work": newProxyTransport(0, tls.Certificate{}),
+		},
+	}
+
+	route, _ := s.getPolicy("www.work.com")
+	assert.Equal(t, proxyRoute{"work", "shared.example.com"}, route)
+	assert.Same(t, s.proxyTransports["work"], s.transport(route))
+	route, _ = s.getPolicy("www.home.com")
+	assert.Equal(t, proxyRoute{"home", "shared.example.com"}, route)
+	assert.Same(t, s.h2Transport, s.transport(route))
+	route, _ = s.getPolicy("example.org")
+	assert.Equal(t, proxyRoute{}, route)
+}
+
 func TestGenPossibleSearches(t *testing.T) {
 	tests := []struct {
 		domain   string
@@ -66,3 +181,39 @@ func BenchmarkGenPossibleSearches(b *testing.B) {
 		genPossibleSearches("a.very.long.subdomain.example.com")
 	}
 }
+
+func TestHandleUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+		assert.Empty(t, r.Header.Get("Proxy-Connection"))
+		conn, bufrw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		bufrw.Flush()
+		io.Copy(conn, bufrw)
+	}))
+	defer upstream.Close()
+	s := &shpClient{
+		config:   &Config{UnmatchedPolicy: UnmatchedPolicy{ProxyName: DirectProxyName}},
+		proxyMap: make(map[string]*Proxy),
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nProxy-Connection: keep-alive\r\n\r\n",
+		upstream.URL, strings.TrimPrefix(upstream.URL, "http://"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
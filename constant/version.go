@@ -0,0 +1,7 @@
+package constant
+
+// Version and BuildTime are set by the Makefile with -ldflags
+var (
+	Version   = "unknown version"
+	BuildTime = "unknown time"
+)
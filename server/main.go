@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,15 +17,27 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/http/pprof"
 	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/http2"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/pires/go-proxyproto"
 	"github.com/winguse/go-shp/auth"
+	"github.com/winguse/go-shp/constant"
 	"github.com/winguse/go-shp/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v2"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -33,8 +49,30 @@ var (
 	bandwidthCounter *prometheus.CounterVec = nil
 	requestCounter   *prometheus.CounterVec = nil
 	authCounter      *prometheus.CounterVec = nil
+	limitCounter     *prometheus.CounterVec = nil
+	authBlockCounter *prometheus.CounterVec = nil
+	timeoutCounter   *prometheus.CounterVec = nil
+	proxyConnCounter *prometheus.CounterVec = nil
 
-	logger = utils.NewLogger(utils.InfoLevel)
+	tunnelSetupHistogram    *prometheus.HistogramVec = nil
+	tunnelDurationHistogram *prometheus.HistogramVec = nil
+	authResultCounter       *prometheus.CounterVec   = nil
+	authLatencyHistogram    *prometheus.HistogramVec = nil
+	tokenCacheCounter       *prometheus.CounterVec   = nil
+	upstreamCounter         *prometheus.CounterVec   = nil
+	tokenCheckCounter       *prometheus.CounterVec   = nil
+
+	logger      = utils.NewLogger(utils.InfoLevel)
+	activeConns = utils.NewConnRegistry()
+	outbound    = (*utils.Outbound)(nil) // nil dials directly
+	timeouts    = utils.TimeoutConfig{}
+	privacy     = (*utils.PrivacyConfig)(nil) // nil keeps the headers
+	tracing     = (*utils.Tracing)(nil)       // nil disables tracing
+
+	revokeEmail        = flag.String("revoke-email", "", "Lock out the user in revocation_file, then exit")
+	restoreEmail       = flag.String("restore-email", "", "Lift the lockout of the user in revocation_file, then exit")
+	revokeToken        = flag.String("revoke-token", "", "Revoke the token in revocation_file, then exit")
+	revokeIssuedBefore = flag.String("revoke-issued-before", "", "Revoke the tokens issued before the RFC3339 time or \"now\" in revocation_file, then exit")
 )
 
 func initMetrics(host string) {
@@ -70,31 +108,230 @@ func initMetrics(host string) {
 		},
 		[]string{},
 	)
+	limitCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "user_limit_rejected",
+			Help:        "The requests / tunnels rejected by the per user limits",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"user", "limit"},
+	)
+	authBlockCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "auth_failure_block",
+			Help:        "The source IPs blocked for failing authentication (blocked), and the requests skipped authentication for it (skipped)",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"event"},
+	)
+	timeoutCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "conn_timeout",
+			Help:        "The tunnels (TCP) / requests (HTTP) closed by timeouts, by reason",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"conn", "reason"},
+	)
+	proxyConnCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "proxy_protocol_conn",
+			Help:        "The connections accepted on the PROXY protocol listeners with trusted_proxies, by the source trusted or not",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"listener", "source"},
+	)
+	tunnelSetupHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "tunnel_setup_seconds",
+			Help:        "The latency of connecting the destinations of the tunnels, by the result ok or the dial error class",
+			ConstLabels: prometheus.Labels{"host": host},
+			Buckets:     prometheus.DefBuckets,
+		},
+		[]string{"result"},
+	)
+	tunnelDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "tunnel_duration_seconds",
+			Help:        "The duration of the tunnels, by kind connect or upgrade",
+			ConstLabels: prometheus.Labels{"host": host},
+			Buckets:     prometheus.ExponentialBuckets(1, 4, 8),
+		},
+		[]string{"kind"},
+	)
+	authResultCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "auth_result",
+			Help:        "The authentication results, by reason, OK if authenticated",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"reason"},
+	)
+	authLatencyHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "auth_backend_seconds",
+			Help:        "The latency of checking the tokens with the OAuth backend, by the result ok or error",
+			ConstLabels: prometheus.Labels{"host": host},
+			Buckets:     prometheus.DefBuckets,
+		},
+		[]string{"result"},
+	)
+	tokenCacheCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "token_cache_lookup",
+			Help:        "The lookups of the token cache, by result hit or miss",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"result"},
+	)
+	upstreamCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "upstream_response",
+			Help:        "The responses of the proxied HTTP requests, by status code",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{"code"},
+	)
+	tokenCheckCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "auth_backend_shared",
+			Help:        "The token checks answered by the backend request of a concurrent check of the same token",
+			ConstLabels: prometheus.Labels{"host": host},
+		},
+		[]string{},
+	)
 	prometheus.MustRegister(connGauge)
 	prometheus.MustRegister(bandwidthCounter)
 	prometheus.MustRegister(requestCounter)
 	prometheus.MustRegister(authCounter)
+	prometheus.MustRegister(limitCounter)
+	prometheus.MustRegister(authBlockCounter)
+	prometheus.MustRegister(timeoutCounter)
+	prometheus.MustRegister(proxyConnCounter)
+	prometheus.MustRegister(tunnelSetupHistogram)
+	prometheus.MustRegister(tunnelDurationHistogram)
+	prometheus.MustRegister(authResultCounter)
+	prometheus.MustRegister(authLatencyHistogram)
+	prometheus.MustRegister(tokenCacheCounter)
+	prometheus.MustRegister(upstreamCounter)
+	prometheus.MustRegister(tokenCheckCounter)
 }
 
 // Config of server
 type Config struct {
-	UpstreamAddr   string            `yaml:"upstream_addr"`
+	UpstreamAddr   string            `yaml:"upstream_addr" redact:"userinfo"`
 	ListenAddr     string            `yaml:"listen_addr"`
 	CertFile       string            `yaml:"cert_file"`
 	KeyFile        string            `yaml:"key_file"`
-	Auth           map[string]string `yaml:"auth"`
+	Auth           map[string]string `yaml:"auth" redact:"secret"`
 	OAuthBackend   *auth.Config      `yaml:"oauth_backend"`
-	MetricsPath    string            `yaml:"metrics_path"`
+	MetricsPath    string            `yaml:"metrics_path" redact:"secret"`
 	Hostname       string            `yaml:"hostname"`
 	BehindTcpProxy bool              `yaml:"behind_tcp_proxy"`
+	RevocationFile string            `yaml:"revocation_file"`
+	ClientCAFile   string            `yaml:"client_ca_file"`
+	Admin          *AdminConfig      `yaml:"admin"`
+
+	// Limits of tunnels and requests per user, unlimited if not configured
+	Limits *utils.LimitsConfig `yaml:"limits"`
+	// AuthFailures blocks the source IPs failing authentication too often
+	AuthFailures *utils.FailureTrackerConfig `yaml:"auth_failures"`
+	// Outbound chains the traffic to the next hops by rules, or dials directly
+	Outbound *utils.OutboundConfig `yaml:"outbound"`
+	// Timeouts of the tunnels and HTTP requests, disabled if zero
+	Timeouts utils.TimeoutConfig `yaml:"timeouts"`
+	// Privacy of the headers of the proxied HTTP requests
+	Privacy *utils.PrivacyConfig `yaml:"privacy"`
+	// Camouflage routes the unauthenticated traffic by host and path, the unmatched go to upstream_addr
+	Camouflage []utils.CamouflageRoute `yaml:"camouflage"`
+	// StaticSite serves the unmatched camouflage traffic instead of upstream_addr
+	StaticSite *utils.StaticSiteConfig `yaml:"static_site"`
+	// ProbeResistance hides the proxy from active probing
+	ProbeResistance *ProbeResistanceConfig `yaml:"probe_resistance"`
+	// Certificates selected by SNI, in addition to cert_file / key_file, the first one is the default
+	Certificates []utils.CertificateConfig `yaml:"certificates"`
+	// Listeners in addition to listen_addr, each with its own settings
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// TrustedProxies the sources whose PROXY headers are used with behind_tcp_proxy, all if empty
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// UntrustedProxyHeader the handling of the PROXY headers from the untrusted sources, reject or ignore
+	UntrustedProxyHeader string `yaml:"untrusted_proxy_header"`
+	// Tracing exports the spans of the requests and the auth checks, disabled if not configured
+	Tracing *utils.TracingConfig `yaml:"tracing"`
+	// TokenCache of the OAuth token checks, the defaults are used if not configured
+	TokenCache *utils.TokenCacheConfig `yaml:"token_cache"`
+}
+
+// MetricsConfig of the metrics served by a listener, protected by basic auth if username is set
+type MetricsConfig struct {
+	Path     string `yaml:"path" redact:"secret"` // default /metrics
+	Pprof    bool   `yaml:"pprof"`                // serves /debug/pprof/ too
+	Username string `yaml:"username"`
+	Password string `yaml:"password" redact:"secret"`
+}
+
+// AdminConfig of the admin API, it is served under the secret path of the proxy listener,
+// and / or on a separate listener. Requests must carry "Authorization: Bearer <token>".
+type AdminConfig struct {
+	Path       string `yaml:"path" redact:"secret"`
+	ListenAddr string `yaml:"listen_addr"`
+	Token      string `yaml:"token" redact:"secret"`
+}
+
+// ProbeResistanceConfig hides the proxy from active probing. The unauthenticated CONNECT and absolute-form
+// requests are forwarded to upstream_addr as received, so they are answered as if the upstream were in front.
+type ProbeResistanceConfig struct {
+	TriggerPath string        `yaml:"trigger_path" redact:"secret"` // the path asking for the credential, default <redirect_base_path>407
+	KnockSecret string        `yaml:"knock_secret" redact:"secret"` // if set, the trigger path must be followed by /<knock>, see utils.Knock
+	KnockWindow time.Duration `yaml:"knock_window"`                 // the clock skew of the knocks accepted, default 1 minute
+	Realm       string        `yaml:"realm"`                        // of Proxy-Authenticate, default Restricted
+}
+
+const (
+	// ServeProxy the authenticated proxy, with the admin API under its secret path
+	ServeProxy = "proxy"
+	// ServeCamouflage the camouflage site
+	ServeCamouflage = "camouflage"
+	// ServeMetrics the metrics under metrics_path
+	ServeMetrics = "metrics"
+
+	// ProxyHeaderReject closes the connections of the PROXY headers from the untrusted sources
+	ProxyHeaderReject = "reject"
+	// ProxyHeaderIgnore accepts the connections, but uses their own source addresses
+	ProxyHeaderIgnore = "ignore"
+)
+
+// ListenerConfig of a listener, all the protocols and features are enabled if not configured
+type ListenerConfig struct {
+	Addr                 string   `yaml:"addr"`
+	TLS                  bool     `yaml:"tls"`                    // with the certificates of the server
+	ProxyProtocol        bool     `yaml:"proxy_protocol"`         // the PROXY protocol header is required
+	TrustedProxies       []string `yaml:"trusted_proxies"`        // the IPs / CIDRs required to send the PROXY headers, all if empty
+	UntrustedProxyHeader string   `yaml:"untrusted_proxy_header"` // the PROXY headers from the others, reject (default) or ignore
+	Protocols            []string `yaml:"protocols"`              // of h1, h2 and h2c
+	Serve                []string `yaml:"serve"`                  // of proxy, camouflage and metrics
+
+	// Metrics of this listener, instead of metrics_path, metrics must be served
+	Metrics *MetricsConfig `yaml:"metrics"`
 }
 
 type defaultHandler struct {
-	reverseProxy   *httputil.ReverseProxy
+	reverseProxy   http.Handler
 	config         Config
 	oAuthBackend   *auth.OAuthBackend
 	tokenCache     *utils.TokenCache
 	metricsHandler http.Handler
+	revocations    *auth.RevocationList
+	clientCAs      *x509.CertPool
+	adminHandler   http.Handler
+	limiter        *utils.UserLimiter
+	authFailures   *utils.FailureTracker
+	authLock       sync.RWMutex // guards config.Auth, which can be changed by admin API
+
+	// transparentProxy forwards the requests as received in probe resistance mode, nil if not
+	transparentProxy http.Handler
+
+	// tokenChecks coalesces the concurrent checks of the same token with the provider
+	tokenChecks singleflight.Group
 }
 
 type flushWriter struct {
@@ -135,6 +372,22 @@ func (t TrafficDirection) str() string {
 	return "U"
 }
 
+// timedOut records the connection closed by the watchdog, if it fired
+func timedOut(username string, connType ConnType, dest string, watchdog *utils.Watchdog) {
+	watchdog.Stop()
+	if reason := watchdog.Reason(); reason != "" {
+		logTimeout(username, connType, dest, reason)
+	}
+}
+
+func logTimeout(username string, connType ConnType, dest string, reason string) {
+	logger.Debug("[%s] %s closed by %s\n", username, dest, reason)
+	timeoutCounter.With(prometheus.Labels{
+		"conn":   connType.str(),
+		"reason": reason,
+	}).Inc()
+}
+
 func statics(username string, connType ConnType, direction TrafficDirection, size int64) {
 	bandwidthCounter.With(prometheus.Labels{
 		"user": username,
@@ -168,74 +421,274 @@ func (f *flushWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
-var headerBlackList = map[string]bool{}
+// listenerHandler serves the features of a listener only
+type listenerHandler struct {
+	handler        *defaultHandler
+	features       map[string]bool // nil serves all
+	metrics        *MetricsConfig  // of the listener, nil if metrics_path is used
+	metricsHandler http.Handler
+}
+
+func (l *listenerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.metrics != nil && (r.URL.Path == l.metrics.Path ||
+		l.metrics.Pprof && strings.HasPrefix(r.URL.Path, "/debug/pprof/")) {
+		l.metricsHandler.ServeHTTP(w, r)
+		return
+	}
+	l.handler.serve(w, r, l.features)
+}
 
 func (h *defaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == h.config.MetricsPath {
+	h.serve(w, r, nil)
+}
+
+// serve the request with the features, nil serves all
+func (h *defaultHandler) serve(w http.ResponseWriter, r *http.Request, features map[string]bool) {
+	enabled := func(feature string) bool { return features == nil || features[feature] }
+	if enabled(ServeMetrics) && h.config.MetricsPath != "" && r.URL.Path == h.config.MetricsPath {
 		h.metricsHandler.ServeHTTP(w, r)
 		return
 	}
+	if !enabled(ServeProxy) {
+		h.handleCamouflage(w, r, enabled(ServeCamouflage))
+		return
+	}
+	// requests without the admin token see the camouflage site
+	if h.adminHandler != nil && h.config.Admin.Path != "" &&
+		strings.HasPrefix(r.URL.Path, h.config.Admin.Path) && h.isAdminAuthorized(r) {
+		http.StripPrefix(strings.TrimSuffix(h.config.Admin.Path, "/"), h.adminHandler).ServeHTTP(w, r)
+		return
+	}
 
-	isAuthTriggerURL := h.oAuthBackend != nil && r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, h.oAuthBackend.RedirectBasePath+"407")
-	authoried, username := h.isAuthenticated(r.Header.Get("Proxy-Authorization"))
-	if isAuthTriggerURL {
+	ctx, span := utils.StartSpan(r.Context(), "request", attribute.String("http.method", r.Method))
+	defer span.End()
+	r = r.WithContext(ctx)
+	isAuthTriggerURL := h.isAuthTrigger(r)
+	authoried, username, credential := h.authenticate(r)
+	// an expired credential was signed by us, so it is safe to ask the client to refresh it
+	isCredentialExpired := !authoried && strings.HasPrefix(username, credentialExpiredPrefix)
+	if isAuthTriggerURL || isCredentialExpired {
 		if authoried {
 			w.WriteHeader(http.StatusOK)
 		} else {
-			w.Header().Add("Proxy-Authenticate", "Basic realm=\"Hi, please show me your token!\"")
+			w.Header().Add("Proxy-Authenticate", "Basic realm=\""+h.realm()+"\"")
 			w.WriteHeader(http.StatusProxyAuthRequired)
 		}
 		w.Write([]byte(""))
 		w.(http.Flusher).Flush()
 	} else {
 		if authoried {
+			span.SetAttributes(tracing.User(username), tracing.Destination(r.Host))
 			requestCounter.With(prometheus.Labels{
 				"user": username,
 			}).Inc()
-			logger.Debug("[%s] %s %s\n", username, r.Method, r.URL)
-			for k := range r.Header {
-				if headerBlackList[strings.ToLower(k)] {
-					r.Header.Del(k)
-				}
+			logger.Debug("[%s] %s %s %s\n", username, r.RemoteAddr, r.Method, r.URL)
+			upgrade := upgradeProtocol(r)
+			utils.RemoveHopByHopHeaders(r.Header)
+			// the upgrade is forwarded, which is the only hop-by-hop header kept
+			if upgrade != "" && r.Method != http.MethodConnect {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", upgrade)
 			}
 			// Strip all sensitive proxy authentication cookies before proxying
 			stripSensitiveCookies(r)
-			proxy(w, r, username)
+			r = r.WithContext(context.WithValue(r.Context(), connCredentialKey{}, credential))
+			h.proxy(w, r, username)
 		} else {
 			if username == "" {
-				logger.Debug("[normal] %s %s\n", r.Method, r.URL)
+				logger.Debug("[normal] %s %s %s\n", r.RemoteAddr, r.Method, r.URL)
 			} else {
-				logger.Debug("{%s} %s %s\n", username, r.Method, r.URL)
+				logger.Debug("{%s} %s %s %s\n", username, r.RemoteAddr, r.Method, r.URL)
 			}
-			h.handleReverseProxy(w, r)
+			h.handleCamouflage(w, r, enabled(ServeCamouflage))
+		}
+	}
+}
+
+// handleCamouflage serves the camouflage site if enabled, or 404
+func (h *defaultHandler) handleCamouflage(w http.ResponseWriter, r *http.Request, enabled bool) {
+	if enabled {
+		h.handleReverseProxy(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// isAuthTrigger the request asking for the credential, the browsers send it only after 407
+func (h *defaultHandler) isAuthTrigger(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	probe := h.config.ProbeResistance
+	if probe == nil {
+		return h.oAuthBackend != nil && strings.HasSuffix(r.URL.Path, h.oAuthBackend.RedirectBasePath+"407")
+	}
+	triggerPath := probe.TriggerPath
+	if triggerPath == "" {
+		if h.oAuthBackend == nil {
+			return false
 		}
+		triggerPath = h.oAuthBackend.RedirectBasePath + "407"
 	}
+	// without the valid knock, it is served as any other request
+	path := r.URL.Path
+	if probe.KnockSecret != "" {
+		i := strings.LastIndex(path, "/")
+		if i < 0 || !utils.VerifyKnock(probe.KnockSecret, path[i+1:], time.Now(), probe.KnockWindow) {
+			return false
+		}
+		path = path[:i]
+	}
+	return strings.HasSuffix(path, triggerPath)
 }
 
-func (h *defaultHandler) isAuthenticated(authHeader string) (bool, string) {
+func (h *defaultHandler) realm() string {
+	if h.config.ProbeResistance == nil {
+		return "Hi, please show me your token!"
+	}
+	if h.config.ProbeResistance.Realm == "" {
+		return "Restricted"
+	}
+	return h.config.ProbeResistance.Realm
+}
+
+// authenticate the request by client certificate or Proxy-Authorization. The source IPs
+// failing too often are not checked at all for a while, so they only see the camouflage site.
+// The credential is nil unless authenticated by a token.
+func (h *defaultHandler) authenticate(r *http.Request) (bool, string, *utils.ConnCredential) {
+	// the real address is used if behind_tcp_proxy, the PROXY protocol listener takes care of it
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+	if h.authFailures.IsBlocked(sourceIP) {
+		authBlockCounter.With(prometheus.Labels{"event": "skipped"}).Inc()
+		return false, "", nil
+	}
+	ctx, span := utils.StartSpan(r.Context(), "auth")
+	credential := (*utils.ConnCredential)(nil)
+	authoried, username := h.isClientCertAuthenticated(r)
+	if !authoried {
+		authoried, username, credential = h.authenticateHeader(ctx, r.Header.Get("Proxy-Authorization"))
+	}
+	reason := authReason(authoried, username)
+	span.SetAttributes(attribute.String("shp.auth_result", reason))
+	span.End()
+	authResultCounter.With(prometheus.Labels{"reason": reason}).Inc()
+	// only the wrong credentials count, not the visitors without one, the expired or revoked
+	// credentials, or the provider errors, which legitimate users run into as well
+	if !authoried && credentialFailures[reason] && h.authFailures.Fail(sourceIP) {
+		authBlockCounter.With(prometheus.Labels{"event": "blocked"}).Inc()
+		logger.Info("%s is blocked for failing authentication too often, last failure: %s\n", sourceIP, username)
+	}
+	return authoried, username, credential
+}
+
+// credentialFailures the reasons of authReason counting towards auth_failures
+var credentialFailures = map[string]bool{
+	"AuthBase64Invalid":           true,
+	"AuthUsernamePasswordInvalid": true,
+	"AuthTokenLengthInvalid":      true,
+	"AuthCredentialInvalid":       true,
+	"AuthTokenAESInvalid":         true,
+	"InvalidEmail":                true,
+}
+
+// authReason the reason label of the authentication result, the failures are "<reason> <email>" or the reason only
+func authReason(authoried bool, username string) string {
+	if authoried {
+		return "OK"
+	}
+	if username == "" {
+		return "NoCredential"
+	}
+	return strings.SplitN(username, " ", 2)[0]
+}
+
+// isClientCertAuthenticated verifies the client certificate against client_ca_file.
+// The certificate is only requested in the TLS handshake but not verified there,
+// so clients without a valid one still see the camouflage site.
+func (h *defaultHandler) isClientCertAuthenticated(r *http.Request) (bool, string) {
+	if h.clientCAs == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false, ""
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         h.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		logger.Debug("client certificate of %s is invalid: %s\n", r.RemoteAddr, err)
+		return false, ""
+	}
+	username := clientCertUsername(cert)
+	if username == "" || h.revocations.IsEmailRevoked(username) {
+		return false, ""
+	}
+	return true, username
+}
+
+// clientCertUsername maps the certificate to a username: email SAN, subject CN, or DNS SAN
+func clientCertUsername(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// credentialExpiredPrefix of the failure reason when the credential is valid but expired
+const credentialExpiredPrefix = "AuthCredentialExpired "
+
+func (h *defaultHandler) isAuthenticated(ctx context.Context, authHeader string) (bool, string) {
+	authoried, username, _ := h.authenticateHeader(ctx, authHeader)
+	return authoried, username
+}
+
+// authenticateHeader checks the Proxy-Authorization header, the credential of the token is returned if authenticated
+func (h *defaultHandler) authenticateHeader(ctx context.Context, authHeader string) (bool, string, *utils.ConnCredential) {
 	s := strings.SplitN(authHeader, " ", 2)
 	if len(s) != 2 {
-		return false, ""
+		return false, "", nil
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		return false, "AuthBase64Invalid"
+		return false, "AuthBase64Invalid", nil
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return false, "AuthUsernamePasswordInvalid"
+		return false, "AuthUsernamePasswordInvalid", nil
 	}
 
 	email := pair[0]
 	token := pair[1]
+	credential := &utils.ConnCredential{Fingerprint: auth.TokenFingerprint(token)}
+
+	// revoked users and tokens are rejected before any cache or backend check
+	if h.revocations.IsEmailRevoked(email) || h.revocations.IsTokenRevoked(token) {
+		return false, "Revoked " + email, nil
+	}
 
 	// check if matched static result
 	// static result no need to check HMAC, because it's fast, hard to probe
-	if expectedToken, ok := h.config.Auth[email]; ok {
+	h.authLock.RLock()
+	expectedToken, ok := h.config.Auth[email]
+	h.authLock.RUnlock()
+	if ok {
 		if subtle.ConstantTimeCompare([]byte(expectedToken), []byte(token)) == 1 {
-			return true, email
+			return true, email, credential
 		}
 	}
 
@@ -245,69 +698,202 @@ func (h *defaultHandler) isAuthenticated(authHeader string) (bool, string) {
 			maxTokenLen = 512
 		}
 		if len(token) == 0 || len(token) > maxTokenLen {
-			return false, "AuthTokenLengthInvalid"
+			return false, "AuthTokenLengthInvalid", nil
+		}
+
+		// self-issued credentials are signed by us, verify offline without the provider
+		if auth.IsCredential(token) {
+			_, span := utils.StartSpan(ctx, "verify_credential")
+			claims, err := h.oAuthBackend.VerifyCredential(token)
+			utils.EndSpan(span, err)
+			if errors.Is(err, auth.ErrCredentialExpired) && claims.Email == email {
+				return false, credentialExpiredPrefix + email, nil
+			}
+			if err != nil {
+				return false, "AuthCredentialInvalid", nil
+			}
+			if claims.Email != email {
+				return false, "InvalidEmail " + email, nil
+			}
+			credential.IssuedAt = time.Unix(claims.IssuedAt, 0)
+			credential.Backend = true
+			if h.isIssuedBeforeRevoked(credential.IssuedAt) {
+				return false, "Revoked " + email, nil
+			}
+			return true, email, credential
 		}
 
 		// because checking oauth token can be slow, so
 		// AES-GCM verification/decryption first to prevent timing attacks / probing
-		rawToken, ok := utils.DecryptToken(token, h.config.OAuthBackend.AESSecret)
+		_, span := utils.StartSpan(ctx, "aes_decrypt")
+		rawToken, ok := h.oAuthBackend.DecryptToken(token)
+		span.End()
 		if !ok {
-			return false, "AuthTokenAESInvalid"
+			return false, "AuthTokenAESInvalid", nil
+		}
+		// the wrapped provider tokens carry no issue time
+		credential.Backend = true
+		if h.isIssuedBeforeRevoked(credential.IssuedAt) {
+			return false, "Revoked " + email, nil
 		}
 		token = rawToken
 		// check token cache
+		_, span = utils.StartSpan(ctx, "token_cache")
 		cachedEmail := h.tokenCache.Get(token)
+		span.SetAttributes(attribute.Bool("shp.cache_hit", cachedEmail != ""))
+		span.End()
 		if cachedEmail != "" {
+			tokenCacheCounter.With(prometheus.Labels{"result": "hit"}).Inc()
 			// cached error
 			if cachedEmail == "err" {
-				return false, "CheckError(cached) " + email
+				return false, "CheckError(cached) " + email, nil
 			}
 			if cachedEmail == email {
-				return true, email
+				return true, email, credential
 			}
-			return false, "InvalidEmail " + email
+			return false, "InvalidEmail " + email, nil
 		}
 
+		tokenCacheCounter.With(prometheus.Labels{"result": "miss"}).Inc()
+		info, err := h.checkToken(ctx, token)
+		// the client has gone away, it is neither a check error nor a wrong credential
+		if err != nil && ctx.Err() != nil {
+			return false, "Canceled " + email, nil
+		}
+		if err != nil {
+			return false, "CheckError " + email, nil
+		}
+		if info.VerifiedEmail && info.Email == email {
+			return true, email, credential
+		}
+	}
+
+	return false, "InvalidEmail " + email, nil
+}
+
+// isIssuedBeforeRevoked of the tokens issued by the OAuth backend. The wrapped provider tokens carry no
+// issue time, so they are revoked by any cutoff unless keep_wrapped_tokens.
+func (h *defaultHandler) isIssuedBeforeRevoked(issuedAt time.Time) bool {
+	if issuedAt.IsZero() && h.config.OAuthBackend != nil && h.config.OAuthBackend.KeepWrappedTokens {
+		return false
+	}
+	return h.revocations.IsIssuedBeforeRevoked(issuedAt)
+}
+
+// isConnRevoked the connections of the revoked users, tokens and the tokens issued before the cutoff
+func (h *defaultHandler) isConnRevoked(conn *utils.ActiveConn) bool {
+	if h.revocations.IsEmailRevoked(conn.User) {
+		return true
+	}
+	credential := conn.Credential
+	return credential != nil && (h.revocations.IsFingerprintRevoked(credential.Fingerprint) ||
+		credential.Backend && h.isIssuedBeforeRevoked(credential.IssuedAt))
+}
+
+// checkToken with the provider and caches the result, the concurrent checks of the same token share one call.
+// The shared call is bounded by the check timeout rather than the callers, who return ctx.Err() once ctx is done.
+func (h *defaultHandler) checkToken(ctx context.Context, token string) (*auth.TokenInfo, error) {
+	timeout := h.config.OAuthBackend.CheckTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	// only the caller whose function is run makes the backend request, the result is sent after it returns
+	leader := false
+	results := h.tokenChecks.DoChan(token, func() (any, error) {
+		leader = true
 		authCounter.With(prometheus.Labels{}).Inc()
+		checkCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
 
 		info := (*auth.TokenInfo)(nil)
 		err := error(nil)
 
+		start := time.Now()
+		checkCtx, span := utils.StartSpan(checkCtx, "check_token")
 		if strings.HasPrefix(token, "SR:") { // SR: server refresh
-			info, err = h.oAuthBackend.CheckRefreshToken(token[3:])
+			info, err = h.oAuthBackend.CheckRefreshToken(checkCtx, token[3:])
 		} else {
-			info, err = h.oAuthBackend.CheckAccessToken(token)
+			info, err = h.oAuthBackend.CheckAccessToken(checkCtx, token)
+		}
+		utils.EndSpan(span, err)
+		result := "ok"
+		if err != nil {
+			result = "error"
 		}
+		authLatencyHistogram.With(prometheus.Labels{"result": result}).Observe(time.Since(start).Seconds())
 
 		// if any errors occurs, will not check again in 3 minutes
 		if err != nil {
-			h.tokenCache.Put(token, "err", 3*time.Minute)
-			return false, "CheckError " + email
+			h.tokenCache.Put(token, "err", h.tokenCache.NegativeTTL())
+			return nil, err
 		}
 
-		// check success, cache for 30 minutes
-		h.tokenCache.Put(token, info.Email, 30*time.Minute)
-		if info.VerifiedEmail && info.Email == email {
-			return true, email
+		// check success, cache for the TTL, default 30 minutes
+		h.tokenCache.Put(token, info.Email, h.tokenCache.TTL())
+		return info, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-results:
+		if !leader {
+			tokenCheckCounter.With(prometheus.Labels{}).Inc()
+		}
+		if r.Err != nil {
+			return nil, r.Err
 		}
+		return r.Val.(*auth.TokenInfo), nil
 	}
+}
 
-	return false, "InvalidEmail " + email
+// connCredentialKey of the request context, the credential the request is authenticated by
+type connCredentialKey struct{}
+
+// connCredential the credential of the request, nil if not authenticated by a token
+func connCredential(r *http.Request) *utils.ConnCredential {
+	credential, _ := r.Context().Value(connCredentialKey{}).(*utils.ConnCredential)
+	return credential
 }
 
-func proxy(w http.ResponseWriter, r *http.Request, username string) {
-	if r.Method == http.MethodConnect {
-		handleTunneling(w, r, username)
+func (h *defaultHandler) proxy(w http.ResponseWriter, r *http.Request, username string) {
+	upgrade := upgradeProtocol(r)
+	if r.Method == http.MethodConnect || upgrade != "" {
+		// the upgraded connections are long lived as the tunnels
+		release, reason := h.limiter.AcquireTunnel(username)
+		if reason != "" {
+			rejectByLimit(w, username, reason)
+			return
+		}
+		defer release()
+		if upgrade != "" {
+			handleUpgrade(w, r, username, upgrade)
+		} else {
+			handleTunneling(w, r, username)
+		}
 	} else {
+		if reason := h.limiter.AllowRequest(username); reason != "" {
+			rejectByLimit(w, username, reason)
+			return
+		}
 		handleHTTP(w, r, username)
 	}
 }
 
+func rejectByLimit(w http.ResponseWriter, username string, reason string) {
+	limitCounter.With(prometheus.Labels{
+		"user":  username,
+		"limit": reason,
+	}).Inc()
+	logger.Debug("[%s] rejected by limit %s\n", username, reason)
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
 var sensitiveProxyCookies = map[string]bool{
 	"access_token":  true,
 	"refresh_token": true,
 	"email":         true,
 	"code":          true,
+	"user_code":     true,
 }
 
 func stripSensitiveCookies(r *http.Request) {
@@ -339,18 +925,24 @@ func (h *defaultHandler) handleReverseProxy(w http.ResponseWriter, r *http.Reque
 	}
 
 	stripSensitiveCookies(r)
+	// a web server would not proxy them, let the upstream answer
+	if h.transparentProxy != nil && (r.Method == http.MethodConnect || !strings.HasPrefix(r.RequestURI, "/")) {
+		h.transparentProxy.ServeHTTP(w, r)
+		return
+	}
 	h.reverseProxy.ServeHTTP(w, r)
 }
 
-func createTCPConn(host string) (*net.TCPConn, error) {
-	destConn, err := net.DialTimeout("tcp", host, 10*time.Second)
-	if err != nil {
-		return nil, err
-	}
-	if tcpConn, ok := destConn.(*net.TCPConn); ok {
-		return tcpConn, nil
+func createTCPConn(ctx context.Context, username string, host string) (net.Conn, error) {
+	return outbound.DialContext(ctx, username, host)
+}
+
+// dialErrorStatus the status code responded for the error of connecting the destination
+func dialErrorStatus(err error) int {
+	if errors.Is(err, utils.ErrDestinationDenied) {
+		return http.StatusForbidden
 	}
-	return nil, errors.New("failed to cast net.Conn to net.TCPConn")
+	return http.StatusBadGateway
 }
 
 func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
@@ -362,18 +954,46 @@ func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
 	return clientConn, bufrw, err
 }
 
+// observeTunnelSetup records the latency of connecting the destination since start
+func observeTunnelSetup(start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = utils.DialErrorClass(err)
+	}
+	tunnelSetupHistogram.With(prometheus.Labels{"result": result}).Observe(time.Since(start).Seconds())
+}
+
+// observeTunnelDuration records the duration of the tunnel of kind since start
+func observeTunnelDuration(kind string, start time.Time) {
+	tunnelDurationHistogram.With(prometheus.Labels{"kind": kind}).Observe(time.Since(start).Seconds())
+}
+
 func handleTunneling(w http.ResponseWriter, r *http.Request, username string) {
-	remoteTCPConn, err := createTCPConn(r.Host)
+	start := time.Now()
+	ctx, span := utils.StartSpan(r.Context(), "dial")
+	remoteConn, err := createTCPConn(tracing.WithClientTrace(ctx), username, r.Host)
+	utils.EndSpan(span, err)
+	observeTunnelSetup(start, err)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		logger.Debug("[%s] failed to connect %s: %s\n", username, r.Host, err)
+		status := dialErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
-	defer remoteTCPConn.Close()
-	ctx := r.Context()
+	logger.Debug("[%s] %s connected to %s\n", username, r.Host, remoteConn.RemoteAddr())
+	defer remoteConn.Close()
+	defer observeTunnelDuration("connect", time.Now())
+	// closing the remote connection tears down the tunnel
+	activeConn := activeConns.Add(username, connCredential(r), r.RemoteAddr, r.Host, func() { remoteConn.Close() })
+	defer activeConns.Remove(activeConn)
+	remoteReader := utils.FirstByteReader(r.Context(), remoteConn)
+	ctx = r.Context()
 	go func() {
 		<-ctx.Done()
-		remoteTCPConn.Close()
+		remoteConn.Close()
 	}()
+	watchdog := utils.NewWatchdog(timeouts, func() { remoteConn.Close() })
+	defer timedOut(username, TCPConn, r.Host, watchdog)
 	w.WriteHeader(http.StatusOK)
 	if r.ProtoMajor == 2 {
 		w.(http.Flusher).Flush() // must flush, or the client won't start the connection
@@ -381,15 +1001,15 @@ func handleTunneling(w http.ResponseWriter, r *http.Request, username string) {
 			// client -> remote
 			connGauge.With(prometheus.Labels{"dir": "remote"}).Inc()
 			defer connGauge.With(prometheus.Labels{"dir": "remote"}).Dec()
-			defer remoteTCPConn.CloseWrite()
-			size := utils.CopyAndPrintError(remoteTCPConn, r.Body, logger)
+			defer utils.CloseWrite(remoteConn)
+			size := utils.CopyAndPrintError(activeConn.UploadWriter(watchdog.Writer(remoteConn)), r.Body, logger)
 			statics(username, TCPConn, Upload, size)
 		}()
 		// remote -> client
 		connGauge.With(prometheus.Labels{"dir": "client"}).Inc()
 		defer connGauge.With(prometheus.Labels{"dir": "client"}).Dec()
-		defer remoteTCPConn.CloseRead()
-		size := utils.CopyAndPrintError(&flushWriter{w}, remoteTCPConn, logger)
+		defer utils.CloseRead(remoteConn)
+		size := utils.CopyAndPrintError(activeConn.DownloadWriter(watchdog.Writer(&flushWriter{w})), remoteReader, logger)
 		statics(username, TCPConn, Download, size)
 	} else {
 		clientConn, bufrw, err := hijack(w)
@@ -405,19 +1025,19 @@ func handleTunneling(w http.ResponseWriter, r *http.Request, username string) {
 			// client -> remote
 			connGauge.With(prometheus.Labels{"dir": "remote"}).Inc()
 			defer connGauge.With(prometheus.Labels{"dir": "remote"}).Dec()
-			defer remoteTCPConn.CloseWrite()
+			defer utils.CloseWrite(remoteConn)
 			var reader io.Reader = clientConn
 			if bufrw != nil && bufrw.Reader.Buffered() > 0 {
 				reader = io.MultiReader(bufrw.Reader, clientConn)
 			}
-			size := utils.CopyAndPrintError(remoteTCPConn, reader, logger)
+			size := utils.CopyAndPrintError(activeConn.UploadWriter(watchdog.Writer(remoteConn)), reader, logger)
 			statics(username, TCPConn, Upload, size)
 		}()
 		connGauge.With(prometheus.Labels{"dir": "client"}).Inc()
 		defer connGauge.With(prometheus.Labels{"dir": "client"}).Dec()
 		// remote -> client
-		defer remoteTCPConn.CloseRead()
-		size := utils.CopyAndPrintError(clientConn, remoteTCPConn, logger)
+		defer utils.CloseRead(remoteConn)
+		size := utils.CopyAndPrintError(activeConn.DownloadWriter(watchdog.Writer(clientConn)), remoteReader, logger)
 		statics(username, TCPConn, Download, size)
 	}
 }
@@ -430,25 +1050,186 @@ func handleHTTP(w http.ResponseWriter, req *http.Request, username string) {
 		req.URL.Host = req.Host
 	}
 	req.RequestURI = ""
+	privacy.FilterRequest(username, req)
 
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(tracing.WithClientTrace(ctx))
+	activeConn := activeConns.Add(username, connCredential(req), req.RemoteAddr, req.URL.Host, cancel)
+	defer activeConns.Remove(activeConn)
+	watchdog := utils.NewWatchdog(timeouts, cancel)
+	defer timedOut(username, HTTPConn, req.URL.Host, watchdog)
+
+	transport, err := outbound.Transport(username, req.URL.Host)
+	if err != nil {
+		logger.Error("[%s] %s\n", username, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
 	pipeRead, pipeWrite := io.Pipe()
+	// unblocks the copy below if the transport returns without draining the body
+	defer pipeRead.Close()
 	fromBody := req.Body
 	req.Body = pipeRead
 	go func() {
 		defer pipeWrite.Close()
 		defer fromBody.Close()
-		size := utils.CopyAndPrintError(pipeWrite, fromBody, logger)
+		size := utils.CopyAndPrintError(activeConn.UploadWriter(watchdog.Writer(pipeWrite)), fromBody, logger)
 		statics(username, HTTPConn, Upload, size)
 	}()
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	responseHeaderTimer := (*time.Timer)(nil)
+	if timeouts.ResponseHeader > 0 {
+		responseHeaderTimer = time.AfterFunc(timeouts.ResponseHeader, cancel)
+	}
+	resp, err := transport.RoundTrip(req)
+	if responseHeaderTimer != nil && !responseHeaderTimer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		logTimeout(username, HTTPConn, req.URL.Host, utils.TimeoutResponseHeader)
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	}
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		status := dialErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 	defer resp.Body.Close()
+	upstreamCounter.With(prometheus.Labels{"code": strconv.Itoa(resp.StatusCode)}).Inc()
+	utils.RemoveHopByHopHeaders(resp.Header)
+	privacy.FilterResponse(resp)
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	size := utils.CopyAndPrintError(w, resp.Body, logger)
+	size := utils.CopyAndPrintError(activeConn.DownloadWriter(watchdog.Writer(w)), resp.Body, logger)
+	statics(username, HTTPConn, Download, size)
+}
+
+// upgradeProtocol the protocol requested to switch to by Upgrade of HTTP/1.1,
+// or by the extended CONNECT of HTTP/2 (RFC 8441), empty if not requested
+func upgradeProtocol(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return r.Header.Get(":protocol")
+	}
+	if !httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") {
+		return ""
+	}
+	return r.Header.Get("Upgrade")
+}
+
+func newWebSocketKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// handleUpgrade forwards the handshake of switching protocols (e.g. WebSocket) to the destination
+// by HTTP/1.1, then streams both directions. The extended CONNECT of HTTP/2 is answered by 200
+// once the destination switched, the destination is reached by https if its port is 443.
+func handleUpgrade(w http.ResponseWriter, r *http.Request, username string, protocol string) {
+	extendedConnect := r.Method == http.MethodConnect
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	outReq.Body = nil
+	outReq.ContentLength = 0
+	if extendedConnect {
+		outReq.Method = http.MethodGet
+		outReq.URL.Scheme = r.URL.Scheme
+		if outReq.URL.Scheme == "" {
+			// the HTTP/2 server keeps :scheme only as the TLS state, which is set for https on the TLS connections
+			outReq.URL.Scheme = "http"
+			if r.TLS != nil {
+				outReq.URL.Scheme = "https"
+			}
+		}
+		outReq.URL.Host = r.Host
+		outReq.Header.Del(":protocol")
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", protocol)
+		if strings.EqualFold(protocol, "websocket") {
+			outReq.Header.Set("Sec-WebSocket-Key", newWebSocketKey())
+		}
+	} else {
+		if outReq.URL.Scheme == "" {
+			outReq.URL.Scheme = "http"
+		}
+		if outReq.URL.Host == "" {
+			outReq.URL.Host = r.Host
+		}
+	}
+
+	privacy.FilterRequest(username, outReq)
+	outReq = outReq.WithContext(tracing.WithClientTrace(outReq.Context()))
+
+	transport, err := outbound.Transport(username, outReq.URL.Host)
+	if err != nil {
+		logger.Error("[%s] %s\n", username, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	start := time.Now()
+	resp, err := transport.RoundTrip(outReq)
+	observeTunnelSetup(start, err)
+	if err != nil {
+		status := dialErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer resp.Body.Close()
+	remoteConn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// refused by the destination
+		utils.RemoveHopByHopHeaders(resp.Header)
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		utils.CopyAndPrintError(w, resp.Body, logger)
+		return
+	}
+	logger.Debug("[%s] %s switched to %s\n", username, outReq.URL.Host, protocol)
+	defer observeTunnelDuration("upgrade", time.Now())
+	activeConn := activeConns.Add(username, connCredential(r), r.RemoteAddr, outReq.URL.Host, func() { remoteConn.Close() })
+	defer activeConns.Remove(activeConn)
+	watchdog := utils.NewWatchdog(timeouts, func() { remoteConn.Close() })
+	defer timedOut(username, HTTPConn, outReq.URL.Host, watchdog)
+
+	clientReader, clientWriter := io.Reader(r.Body), io.Writer(&flushWriter{w})
+	if extendedConnect {
+		utils.RemoveHopByHopHeaders(resp.Header)
+		resp.Header.Del("Sec-Websocket-Accept")
+		privacy.FilterResponse(resp)
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+	} else {
+		clientConn, bufrw, err := hijack(w)
+		if err != nil {
+			logger.Error("hijack failed: %s", err)
+			return
+		}
+		defer clientConn.Close()
+		fmt.Fprintf(bufrw, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(bufrw)
+		bufrw.WriteString("\r\n")
+		if err := bufrw.Flush(); err != nil {
+			return
+		}
+		clientReader, clientWriter = clientConn, clientConn
+		if bufrw.Reader.Buffered() > 0 {
+			clientReader = io.MultiReader(bufrw.Reader, clientConn)
+		}
+	}
+	go func() {
+		// client -> remote, the upgraded connection can not be half closed
+		connGauge.With(prometheus.Labels{"dir": "remote"}).Inc()
+		defer connGauge.With(prometheus.Labels{"dir": "remote"}).Dec()
+		defer remoteConn.Close()
+		size := utils.CopyAndPrintError(activeConn.UploadWriter(watchdog.Writer(remoteConn)), clientReader, logger)
+		statics(username, HTTPConn, Upload, size)
+	}()
+	// remote -> client
+	connGauge.With(prometheus.Labels{"dir": "client"}).Inc()
+	defer connGauge.With(prometheus.Labels{"dir": "client"}).Dec()
+	size := utils.CopyAndPrintError(activeConn.DownloadWriter(watchdog.Writer(clientWriter)), remoteConn, logger)
 	statics(username, HTTPConn, Download, size)
 }
 
@@ -469,78 +1250,621 @@ func newCamouflageReverseProxy(targetURL *url.URL) *httputil.ReverseProxy {
 	}
 }
 
+// newTransparentReverseProxy forwards the request line and Host as received
+func newTransparentReverseProxy(targetURL *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL = &url.URL{Scheme: targetURL.Scheme, Host: targetURL.Host, Opaque: r.In.RequestURI}
+			r.Out.Host = r.In.Host
+		},
+	}
+}
+
+// transparentProxy forwards the request as received to the target, then relays the connection byte for byte,
+// so the responses are exactly the ones of the target, with its header order, framing and connection handling.
+// The HTTP/2 requests cannot be relayed, they are reverse proxied.
+type transparentProxy struct {
+	target  *url.URL
+	reverse *httputil.ReverseProxy
+}
+
+func newTransparentProxy(targetURL *url.URL) *transparentProxy {
+	return &transparentProxy{target: targetURL, reverse: newTransparentReverseProxy(targetURL)}
+}
+
+func (p *transparentProxy) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	host := p.target.Host
+	if p.target.Scheme != "https" {
+		if p.target.Port() == "" {
+			host = net.JoinHostPort(p.target.Hostname(), "80")
+		}
+		return dialer.DialContext(ctx, "tcp", host)
+	}
+	if p.target.Port() == "" {
+		host = net.JoinHostPort(p.target.Hostname(), "443")
+	}
+	tlsDialer := &tls.Dialer{
+		NetDialer: dialer,
+		Config:    &tls.Config{ServerName: p.target.Hostname(), NextProtos: []string{"http/1.1"}},
+	}
+	return tlsDialer.DialContext(ctx, "tcp", host)
+}
+
+func (p *transparentProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if r.ProtoMajor != 1 || !ok {
+		p.reverse.ServeHTTP(w, r)
+		return
+	}
+	upstream, err := p.dial(r.Context())
+	if err != nil {
+		logger.Error("Failed to dial upstream: %s\n", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("Failed to hijack: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// the body is not read yet, it is relayed as received with the following requests
+	head := &strings.Builder{}
+	fmt.Fprintf(head, "%s %s %s\r\nHost: %s\r\n", r.Method, r.RequestURI, r.Proto, r.Host)
+	r.Header.Write(head)
+	if len(r.TransferEncoding) > 0 {
+		fmt.Fprintf(head, "Transfer-Encoding: %s\r\n", strings.Join(r.TransferEncoding, ", "))
+	}
+	head.WriteString("\r\n")
+	if _, err := io.WriteString(upstream, head.String()); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(upstream, bufrw.Reader)
+		utils.CloseWrite(upstream)
+	}()
+	io.Copy(conn, upstream)
+}
+
+// runRevocationCommand updates the revocation file if any revocation flag is set
+func runRevocationCommand(config *Config) bool {
+	if *revokeEmail == "" && *restoreEmail == "" && *revokeToken == "" && *revokeIssuedBefore == "" {
+		return false
+	}
+	if config.RevocationFile == "" {
+		log.Fatal("revocation_file is not configured")
+	}
+	revocations, err := auth.NewRevocationList(config.RevocationFile)
+	if err != nil {
+		log.Fatal("Failed to load revocation file: ", err)
+	}
+	if *revokeEmail != "" {
+		err = revocations.RevokeEmail(*revokeEmail)
+	} else if *restoreEmail != "" {
+		err = revocations.RestoreEmail(*restoreEmail)
+	} else if *revokeToken != "" {
+		err = revocations.RevokeFingerprint(auth.TokenFingerprint(*revokeToken))
+	} else {
+		issuedBefore := time.Now()
+		if *revokeIssuedBefore != "now" {
+			issuedBefore, err = time.Parse(time.RFC3339, *revokeIssuedBefore)
+			if err != nil {
+				log.Fatal("Failed to parse time: ", err)
+			}
+		}
+		err = revocations.RevokeIssuedBefore(issuedBefore)
+	}
+	if err != nil {
+		log.Fatal("Failed to update revocation file: ", err)
+	}
+	return true
+}
+
+// watchRevocations reloads the revocation file and tears down the connections revoked
+func (h *defaultHandler) watchRevocations() {
+	for range time.Tick(5 * time.Second) {
+		changed, err := h.revocations.Reload()
+		if err != nil {
+			logger.Error("Failed to reload revocation file: %s\n", err)
+			continue
+		}
+		if changed {
+			closed := activeConns.CloseMatched(h.isConnRevoked)
+			logger.Info("Revocation file reloaded, %d connections closed.\n", closed)
+		}
+	}
+}
+
+func watchCertificates(certStore *utils.CertStore) {
+	for range time.Tick(time.Minute) {
+		changed, err := certStore.Reload()
+		if err != nil {
+			logger.Error("Failed to reload certificates: %s\n", err)
+			continue
+		}
+		if changed {
+			logger.Info("Certificates reloaded.\n")
+		}
+	}
+}
+
+func (h *defaultHandler) isAdminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.config.Admin.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(h.config.Admin.Token)) == 1
+}
+
+// requireAdminToken for the separate admin listener, which needs no camouflage
+func (h *defaultHandler) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdminAuthorized(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func makeJSONResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Failed to write JSON response: %s\n", err)
+	}
+}
+
+// redactedConfig the config without secrets, see the redact tags of the fields
+func (h *defaultHandler) redactedConfig() Config {
+	h.authLock.RLock()
+	defer h.authLock.RUnlock()
+	return utils.Redact(h.config)
+}
+
+// newAdminHandler the admin API to manage users and active connections
+func (h *defaultHandler) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		makeJSONResponse(w, activeConns.List())
+	})
+	mux.HandleFunc("DELETE /tunnels/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !activeConns.Close(id) {
+			http.Error(w, "tunnel not found", http.StatusNotFound)
+			return
+		}
+		makeJSONResponse(w, map[string]int{"closed": 1})
+	})
+	mux.HandleFunc("DELETE /users/{user}/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		makeJSONResponse(w, map[string]int{"closed": activeConns.CloseUser(r.PathValue("user"))})
+	})
+	mux.HandleFunc("GET /users", func(w http.ResponseWriter, r *http.Request) {
+		h.authLock.RLock()
+		users := make([]string, 0, len(h.config.Auth))
+		for user := range h.config.Auth {
+			users = append(users, user)
+		}
+		h.authLock.RUnlock()
+		sort.Strings(users)
+		makeJSONResponse(w, users)
+	})
+	// static users changed here are not saved to the config file
+	mux.HandleFunc("PUT /users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		input := struct {
+			Token string `json:"token"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Token == "" {
+			http.Error(w, "token is required", http.StatusBadRequest)
+			return
+		}
+		h.authLock.Lock()
+		if h.config.Auth == nil {
+			h.config.Auth = make(map[string]string)
+		}
+		h.config.Auth[r.PathValue("user")] = input.Token
+		h.authLock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		h.authLock.Lock()
+		_, ok := h.config.Auth[user]
+		delete(h.config.Auth, user)
+		h.authLock.Unlock()
+		if !ok {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		makeJSONResponse(w, map[string]int{"closed": activeConns.CloseUser(user)})
+	})
+	mux.HandleFunc("POST /token-cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		makeJSONResponse(w, map[string]int{"flushed": h.tokenCache.Flush()})
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		makeJSONResponse(w, map[string]string{"version": constant.Version, "build_time": constant.BuildTime})
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		content, err := yaml.Marshal(h.redactedConfig())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(content)
+	})
+	return mux
+}
+
+// newMetricsHandler serves the metrics and pprof of a listener
+func newMetricsHandler(config MetricsConfig, metricsHandler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	path := config.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux.Handle(path, metricsHandler)
+	if config.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	if config.Username == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(config.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// newListenerServer the server of the listener, with its protocols and features
+func newListenerServer(config ListenerConfig, handler *defaultHandler, tlsConfig *tls.Config, readHeaderTimeout time.Duration) (*http.Server, error) {
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		Protocols:         new(http.Protocols),
+		TLSConfig:         tlsConfig.Clone(),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	listener := &listenerHandler{handler: handler}
+	if len(config.Serve) > 0 {
+		listener.features = make(map[string]bool)
+		for _, feature := range config.Serve {
+			switch feature {
+			case ServeProxy, ServeCamouflage, ServeMetrics:
+				listener.features[feature] = true
+			default:
+				return nil, fmt.Errorf("unknown feature to serve: %s", feature)
+			}
+		}
+	}
+	if config.Metrics != nil {
+		if listener.features != nil && !listener.features[ServeMetrics] {
+			return nil, errors.New("metrics is configured but not served")
+		}
+		metrics := *config.Metrics
+		if metrics.Path == "" {
+			metrics.Path = "/metrics"
+		}
+		listener.metrics = &metrics
+		listener.metricsHandler = newMetricsHandler(metrics, handler.metricsHandler)
+	}
+	if listener.features != nil || listener.metrics != nil {
+		server.Handler = listener
+	}
+	protocols := config.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{"h1", "h2", "h2c"}
+	}
+	for _, protocol := range protocols {
+		switch protocol {
+		case "h1":
+			server.Protocols.SetHTTP1(true)
+		case "h2":
+			server.Protocols.SetHTTP2(true)
+		case "h2c":
+			server.Protocols.SetUnencryptedHTTP2(true)
+		default:
+			return nil, fmt.Errorf("unknown protocol: %s", protocol)
+		}
+	}
+	if server.Protocols.HTTP2() {
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// proxyProtocolPolicy requires the PROXY headers from the trusted proxies, and rejects or ignores them from the others
+func proxyProtocolPolicy(config ListenerConfig) (proxyproto.ConnPolicyFunc, error) {
+	untrusted := proxyproto.REJECT
+	switch config.UntrustedProxyHeader {
+	case "", ProxyHeaderReject:
+	case ProxyHeaderIgnore:
+		untrusted = proxyproto.IGNORE
+	default:
+		return nil, fmt.Errorf("unknown untrusted_proxy_header: %s", config.UntrustedProxyHeader)
+	}
+	policy, err := proxyproto.PolicyFromRanges(config.TrustedProxies, proxyproto.REQUIRE, untrusted)
+	if err != nil {
+		return nil, err
+	}
+	return func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		p, err := policy(options)
+		source := "trusted"
+		if p != proxyproto.REQUIRE {
+			source = "untrusted"
+		}
+		proxyConnCounter.With(prometheus.Labels{"listener": config.Addr, "source": source}).Inc()
+		return p, err
+	}, nil
+}
+
+// listen on the address of the listener, with the PROXY protocol if enabled
+func listen(config ListenerConfig, keepAlive time.Duration) (net.Listener, error) {
+	policy := proxyproto.ConnPolicyFunc(nil)
+	if config.ProxyProtocol && len(config.TrustedProxies) > 0 {
+		var err error
+		if policy, err = proxyProtocolPolicy(config); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := (&net.ListenConfig{KeepAlive: keepAlive}).Listen(context.Background(), "tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if !config.ProxyProtocol {
+		return ln, nil
+	}
+	if policy == nil {
+		logger.Info("The PROXY headers on %s are trusted from any source, consider trusted_proxies .\n", config.Addr)
+	}
+	return &proxyproto.Listener{
+		Listener:   ln,
+		ConnPolicy: policy,
+	}, nil
+}
+
+// shutdownTimeout of the requests in flight on SIGINT or SIGTERM
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	flag.Parse()
-	hopByHopHeaders := []string{
-		"Connection",
-		"Keep-Alive",
-		"Proxy-Authenticate",
-		"Proxy-Authorization",
-		"Trailer",
-		"TE",
-		"Transfer-Encoding",
-		"Upgrade",
-	}
-	for _, header := range hopByHopHeaders {
-		headerBlackList[strings.ToLower(header)] = true
-	}
 	config := &Config{}
 	utils.LoadConfigFile(*configFile, config)
+	if runRevocationCommand(config) {
+		return
+	}
 	reverseProxyURL, err := url.Parse(config.UpstreamAddr)
 	if err != nil {
 		log.Fatal("Fail to parse reverse proxy url", err)
 	}
-	reverseProxy := newCamouflageReverseProxy(reverseProxyURL)
-	logger.Info("Listening on %s, upstream to %s .\n", config.ListenAddr, config.UpstreamAddr)
+	reverseProxy := http.Handler(newCamouflageReverseProxy(reverseProxyURL))
+	if config.StaticSite != nil {
+		reverseProxy, err = utils.NewStaticSite(*config.StaticSite)
+		if err != nil {
+			log.Fatal("Failed to init static site: ", err)
+		}
+	}
+	if len(config.Camouflage) > 0 {
+		reverseProxy, err = utils.NewCamouflage(config.Camouflage, reverseProxy, logger)
+		if err != nil {
+			log.Fatal("Failed to init camouflage: ", err)
+		}
+	}
+	if config.StaticSite != nil {
+		logger.Info("Serving the static site %s .\n", config.StaticSite.Root)
+	} else {
+		logger.Info("Upstream to %s .\n", config.UpstreamAddr)
+	}
 	oAuthBackend := &auth.OAuthBackend{}
 	if config.OAuthBackend != nil {
-		oAuthBackend.Init(config.OAuthBackend)
+		if err := oAuthBackend.Init(config.OAuthBackend); err != nil {
+			log.Fatal("Failed to init oauth backend: ", err)
+		}
 	} else {
 		oAuthBackend = nil
 	}
-	tokenCache := utils.NewTokenCache()
-	h2s := &http2.Server{}
-	server := &http.Server{
-		Addr: config.ListenAddr,
-		Handler: &defaultHandler{
-			reverseProxy,
-			*config,
-			oAuthBackend,
-			tokenCache,
-			promhttp.Handler(),
-		},
-		Protocols: new(http.Protocols),
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
+	tokenCacheConfig := utils.TokenCacheConfig{}
+	if config.TokenCache != nil {
+		tokenCacheConfig = *config.TokenCache
 	}
-	server.Protocols.SetHTTP1(true)
-	server.Protocols.SetHTTP2(true)
-	server.Protocols.SetUnencryptedHTTP2(true)
-	if err := http2.ConfigureServer(server, h2s); err != nil {
-		log.Fatal("Failed to configure http2: ", err)
+	tokenCache, err := utils.NewTokenCacheWithConfig(tokenCacheConfig)
+	if err != nil {
+		log.Fatal("Failed to init token cache: ", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	certificates := config.Certificates
+	if config.CertFile != "" && config.KeyFile != "" {
+		certificates = append([]utils.CertificateConfig{{CertFile: config.CertFile, KeyFile: config.KeyFile}}, certificates...)
+	}
+	certStore := (*utils.CertStore)(nil)
+	if len(certificates) > 0 {
+		certStore, err = utils.NewCertStore(certificates)
+		if err != nil {
+			log.Fatal("Failed to load certificates: ", err)
+		}
+		tlsConfig.GetCertificate = certStore.GetCertificate
+		go watchCertificates(certStore)
+	}
+	clientCAs := (*x509.CertPool)(nil)
+	if config.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			log.Fatal("Failed to read client CA file: ", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			log.Fatal("No certificate found in client CA file")
+		}
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	revocations := (*auth.RevocationList)(nil)
+	if config.RevocationFile != "" {
+		revocations, err = auth.NewRevocationList(config.RevocationFile)
+		if err != nil {
+			log.Fatal("Failed to load revocation file: ", err)
+		}
+	}
+	if oAuthBackend != nil {
+		oAuthBackend.Revocations = revocations
+	}
+	handler := &defaultHandler{
+		reverseProxy:   reverseProxy,
+		config:         *config,
+		oAuthBackend:   oAuthBackend,
+		tokenCache:     tokenCache,
+		metricsHandler: promhttp.Handler(),
+		revocations:    revocations,
+		clientCAs:      clientCAs,
+	}
+	if revocations != nil {
+		go handler.watchRevocations()
+	}
+	// the static site answers them as any other requests
+	if config.ProbeResistance != nil && config.StaticSite == nil {
+		handler.transparentProxy = newTransparentProxy(reverseProxyURL)
+	}
+	if config.Outbound != nil {
+		outbound, err = utils.NewOutbound(*config.Outbound, logger)
+		if err != nil {
+			log.Fatal("Failed to init outbound: ", err)
+		}
+	}
+	timeouts = config.Timeouts
+	privacy = config.Privacy
+	if config.Tracing != nil {
+		tracing, err = utils.NewTracing(*config.Tracing)
+		if err != nil {
+			log.Fatal("Failed to init tracing: ", err)
+		}
+	}
+	if config.AuthFailures != nil {
+		handler.authFailures = utils.NewFailureTracker(*config.AuthFailures)
+	}
+	if config.Limits != nil {
+		handler.limiter = utils.NewUserLimiter(*config.Limits)
+	}
+	if config.Admin != nil {
+		if config.Admin.Token == "" {
+			log.Fatal("admin token is not configured")
+		}
+		handler.adminHandler = handler.newAdminHandler()
+		if config.Admin.ListenAddr != "" {
+			go func() {
+				logger.Info("Admin API listening on %s .\n", config.Admin.ListenAddr)
+				server := &http.Server{
+					Addr:              config.Admin.ListenAddr,
+					Handler:           handler.requireAdminToken(handler.adminHandler),
+					ReadHeaderTimeout: config.Timeouts.RequestHeader,
+				}
+				err := server.ListenAndServe()
+				tracing.Fatal("Failed to serve admin API: ", err)
+			}()
+		}
 	}
 	initMetrics(config.Hostname)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "auth_failure_blocked_ips",
+			Help:        "The source IPs blocked for failing authentication currently",
+			ConstLabels: prometheus.Labels{"host": config.Hostname},
+		},
+		func() float64 { return float64(handler.authFailures.Blocked()) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "token_cache_size",
+			Help:        "The tokens cached currently",
+			ConstLabels: prometheus.Labels{"host": config.Hostname},
+		},
+		func() float64 { return float64(tokenCache.Len()) },
+	))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name:        "token_cache_evictions",
+			Help:        "The tokens evicted from the cache for max_size",
+			ConstLabels: prometheus.Labels{"host": config.Hostname},
+		},
+		func() float64 { return float64(tokenCache.Evictions()) },
+	))
 
-	ln, err := net.Listen("tcp", server.Addr)
-	if err != nil {
-		panic(err)
+	listeners := config.Listeners
+	if config.ListenAddr != "" {
+		listeners = append([]ListenerConfig{{
+			Addr:                 config.ListenAddr,
+			TLS:                  certStore != nil,
+			ProxyProtocol:        config.BehindTcpProxy,
+			TrustedProxies:       config.TrustedProxies,
+			UntrustedProxyHeader: config.UntrustedProxyHeader,
+		}}, listeners...)
 	}
-
-	if config.BehindTcpProxy {
-		proxyListener := &proxyproto.Listener{
-			Listener: ln,
+	if len(listeners) == 0 {
+		log.Fatal("No listener configured")
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	errs := make(chan error, len(listeners))
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, listenerConfig := range listeners {
+		if listenerConfig.TLS && certStore == nil {
+			log.Fatal("No certificate configured for the TLS listener ", listenerConfig.Addr)
+		}
+		server, err := newListenerServer(listenerConfig, handler, tlsConfig, config.Timeouts.RequestHeader)
+		if err != nil {
+			log.Fatal("Failed to configure listener ", listenerConfig.Addr, ": ", err)
 		}
-		ln = proxyListener
+		ln, err := listen(listenerConfig, config.Timeouts.KeepAlive)
+		if err != nil {
+			log.Fatal("Failed to listen on ", listenerConfig.Addr, ": ", err)
+		}
+		defer ln.Close()
+		logger.Info("Listening on %s, TLS: %t, protocols: %v, serving: %v .\n",
+			listenerConfig.Addr, listenerConfig.TLS, listenerConfig.Protocols, listenerConfig.Serve)
+		servers = append(servers, server)
+		go func() {
+			if listenerConfig.TLS {
+				errs <- server.ServeTLS(ln, "", "")
+			} else {
+				errs <- server.Serve(ln)
+			}
+		}()
 	}
-	defer ln.Close()
-
-	if config.CertFile != "" && config.KeyFile != "" {
-		err = server.ServeTLS(ln, config.CertFile, config.KeyFile)
-	} else {
-		err = server.Serve(ln)
+	select {
+	case err := <-errs:
+		tracing.Fatal("Failed to serve: ", err)
+	case sig := <-signals:
+		logger.Info("Shutting down on %s .\n", sig)
 	}
-	if err != nil {
-		log.Fatal("Failed to serve: ", err)
+	// the hijacked tunnels are not waited for, they are closed on exit
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("Failed to shut down the listener %s: %s\n", server.Addr, err)
+		}
+	}
+	outbound.Stop()
+	if err := tokenCache.Stop(); err != nil {
+		logger.Error("Failed to save the token cache: %s\n", err)
+	}
+	if err := tracing.Shutdown(ctx); err != nil {
+		logger.Error("Failed to export the spans: %s\n", err)
 	}
 }
@@ -12,6 +12,7 @@ import (
 )
 
 // deriveKey derives a 32-byte (256-bit) AES key from secret using SHA-256.
+// It is the legacy derivation of unversioned tokens, Keyring derives keys by HKDF.
 func deriveKey(secret string) []byte {
 	hash := sha256.Sum256([]byte(secret))
 	return hash[:]
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CamouflageRoute routes the camouflage traffic matched to its upstreams
+type CamouflageRoute struct {
+	Hosts      []string `yaml:"hosts"`       // matched by Host or SNI, empty matches all
+	PathPrefix string   `yaml:"path_prefix"` // empty matches all
+	// Upstreams the first healthy one is used, the default upstream if none
+	Upstreams     []string          `yaml:"upstreams" redact:"userinfo"`
+	SetHeaders    map[string]string `yaml:"set_headers" redact:"secret"` // of the requests to the upstream, Host included
+	RemoveHeaders []string          `yaml:"remove_headers"`
+	// HealthCheckInterval 0 disables health check, the upstream is healthy if it responds below 500
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	HealthCheckPath     string        `yaml:"health_check_path"` // default /
+}
+
+type camouflageUpstream struct {
+	url     *url.URL
+	proxy   *httputil.ReverseProxy
+	healthy atomic.Bool
+}
+
+type camouflageRoute struct {
+	CamouflageRoute
+	upstreams []*camouflageUpstream
+}
+
+// Camouflage serves the unauthenticated traffic by the first matched route,
+// the unmatched are served by the default handler
+type Camouflage struct {
+	routes   []*camouflageRoute
+	fallback http.Handler
+	logger   *Logger
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCamouflage a Camouflage, the health check of the upstreams starts in background
+func NewCamouflage(routes []CamouflageRoute, fallback http.Handler, logger *Logger) (*Camouflage, error) {
+	c := &Camouflage{fallback: fallback, logger: logger, stop: make(chan struct{})}
+	for _, config := range routes {
+		if len(config.Upstreams) == 0 {
+			return nil, errors.New("no upstream for camouflage route")
+		}
+		route := &camouflageRoute{CamouflageRoute: config}
+		// a copy, the hosts of config are kept as they are
+		route.Hosts = make([]string, len(config.Hosts))
+		for i, host := range config.Hosts {
+			route.Hosts[i] = strings.ToLower(host)
+		}
+		for _, upstream := range config.Upstreams {
+			u, err := url.Parse(upstream)
+			if err != nil {
+				return nil, err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return nil, errors.New("invalid camouflage upstream: " + upstream)
+			}
+			route.upstreams = append(route.upstreams, newCamouflageUpstream(u, config))
+		}
+		c.routes = append(c.routes, route)
+	}
+	for _, route := range c.routes {
+		if route.HealthCheckInterval > 0 {
+			for _, upstream := range route.upstreams {
+				go c.checkHealth(upstream, route.HealthCheckInterval, route.HealthCheckPath)
+			}
+		}
+	}
+	return c, nil
+}
+
+func newCamouflageUpstream(u *url.URL, config CamouflageRoute) *camouflageUpstream {
+	upstream := &camouflageUpstream{url: u}
+	upstream.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			r.Out.Header.Del("X-Forwarded-For")
+			for name, value := range config.SetHeaders {
+				if strings.EqualFold(name, "Host") {
+					r.Out.Host = value
+				} else {
+					r.Out.Header.Set(name, value)
+				}
+			}
+			for _, name := range config.RemoveHeaders {
+				r.Out.Header.Del(name)
+			}
+		},
+	}
+	upstream.healthy.Store(true)
+	return upstream
+}
+
+// Stop the health check of the upstreams
+func (c *Camouflage) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// checkHealth of the upstream at once, then every interval till stopped
+func (c *Camouflage) checkHealth(upstream *camouflageUpstream, interval time.Duration, path string) {
+	if path == "" {
+		path = "/"
+	}
+	target := upstream.url.JoinPath(path).String()
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.probe(client, upstream, target)
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe the upstream, the health is logged when changed
+func (c *Camouflage) probe(client *http.Client, upstream *camouflageUpstream, target string) {
+	resp, err := client.Get(target)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			err = errors.New(resp.Status)
+		}
+	}
+	if upstream.healthy.Swap(err == nil) != (err == nil) {
+		if err == nil {
+			c.logger.Info("Camouflage upstream %s is healthy again.\n", upstream.url)
+		} else {
+			c.logger.Error("Camouflage upstream %s is unhealthy: %s\n", upstream.url, err)
+		}
+	}
+}
+
+func (r *camouflageRoute) match(req *http.Request) bool {
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	if contains(r.Hosts, strings.ToLower(host)) {
+		return true
+	}
+	return req.TLS != nil && contains(r.Hosts, strings.ToLower(req.TLS.ServerName))
+}
+
+func (c *Camouflage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range c.routes {
+		if !route.match(r) {
+			continue
+		}
+		for _, upstream := range route.upstreams {
+			if upstream.healthy.Load() {
+				upstream.proxy.ServeHTTP(w, r)
+				return
+			}
+		}
+		break
+	}
+	c.fallback.ServeHTTP(w, r)
+}
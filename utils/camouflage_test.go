@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSite(t *testing.T, name string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.Host + " " + r.Header.Get("X-Site") + r.Header.Get("Cookie")))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCamouflage(t *testing.T) {
+	blog := newTestSite(t, "blog")
+	shop := newTestSite(t, "shop")
+	api := newTestSite(t, "api")
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default"))
+	})
+	c, err := NewCamouflage([]CamouflageRoute{
+		{Hosts: []string{"Blog.example.com"}, Upstreams: []string{blog.URL}},
+		{Hosts: []string{"shop.example.com"}, PathPrefix: "/api/", Upstreams: []string{api.URL}},
+		{
+			Hosts:         []string{"shop.example.com"},
+			Upstreams:     []string{shop.URL},
+			SetHeaders:    map[string]string{"Host": "shop.internal", "X-Site": "shop"},
+			RemoveHeaders: []string{"Cookie"},
+		},
+	}, fallback, NewLogger(InfoLevel))
+	assert.NoError(t, err)
+
+	get := func(host string, path string) string {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		r.Header.Set("Cookie", "a=b")
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Body)
+		return string(body)
+	}
+	assert.Equal(t, "blog "+blog.Listener.Addr().String()+" a=b", get("blog.example.com:443", "/"))
+	assert.Equal(t, "api "+api.Listener.Addr().String()+" a=b", get("shop.example.com", "/api/items"))
+	assert.Equal(t, "shop shop.internal shop", get("shop.example.com", "/"))
+	assert.Equal(t, "default", get("other.example.com", "/"))
+
+	// unhealthy upstream falls back to the default
+	c.routes[0].upstreams[0].healthy.Store(false)
+	assert.Equal(t, "default", get("blog.example.com", "/"))
+}
+
+func TestCamouflageHealthCheck(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	hosts := []string{"Blog.example.com"}
+	c, err := NewCamouflage([]CamouflageRoute{
+		{Hosts: hosts, Upstreams: []string{down.URL}, HealthCheckInterval: time.Hour},
+	}, http.NotFoundHandler(), NewLogger(InfoLevel))
+	assert.NoError(t, err)
+	defer c.Stop()
+	assert.Equal(t, []string{"Blog.example.com"}, hosts)
+
+	// probed at start, not after the interval
+	assert.Eventually(t, func() bool { return !c.routes[0].upstreams[0].healthy.Load() }, time.Second, 10*time.Millisecond)
+}
+
+func TestCamouflageConfigInvalid(t *testing.T) {
+	_, err := NewCamouflage([]CamouflageRoute{{Hosts: []string{"example.com"}}}, nil, NewLogger(InfoLevel))
+	assert.EqualError(t, err, "no upstream for camouflage route")
+	_, err = NewCamouflage([]CamouflageRoute{{Upstreams: []string{"ftp://example.com"}}}, nil, NewLogger(InfoLevel))
+	assert.EqualError(t, err, "invalid camouflage upstream: ftp://example.com")
+}
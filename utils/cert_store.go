@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CertificateConfig a certificate and its key, in PEM
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// CertStore selects the certificates by SNI, the first one is the default for the unknown names
+type CertStore struct {
+	configs []CertificateConfig
+	l       sync.RWMutex
+	digest  [sha256.Size]byte
+	certs   []*tls.Certificate
+	names   map[string]*tls.Certificate // lower case, wildcards included, the first certificate wins
+}
+
+// NewCertStore a CertStore loaded from the files
+func NewCertStore(configs []CertificateConfig) (*CertStore, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	s := &CertStore{configs: configs}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload the certificates if the files are changed on disk, the loaded are kept on error
+func (s *CertStore) Reload() (bool, error) {
+	hash := sha256.New()
+	pairs := make([][2][]byte, 0, len(s.configs))
+	for _, config := range s.configs {
+		certPEM, err := os.ReadFile(config.CertFile)
+		if err != nil {
+			return false, err
+		}
+		keyPEM, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		hash.Write(certPEM)
+		hash.Write(keyPEM)
+		pairs = append(pairs, [2][]byte{certPEM, keyPEM})
+	}
+	digest := [sha256.Size]byte(hash.Sum(nil))
+	s.l.RLock()
+	unchanged := digest == s.digest
+	s.l.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certs := make([]*tls.Certificate, 0, len(pairs))
+	names := make(map[string]*tls.Certificate)
+	for i, pair := range pairs {
+		cert, err := tls.X509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", s.configs[i].CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return false, fmt.Errorf("%s: %w", s.configs[i].CertFile, err)
+			}
+		}
+		certNames := cert.Leaf.DNSNames
+		if len(certNames) == 0 && cert.Leaf.Subject.CommonName != "" {
+			certNames = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range certNames {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok {
+				names[name] = &cert
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.certs = certs
+	s.names = names
+	s.digest = digest
+	return true, nil
+}
+
+// GetCertificate for tls.Config, by the exact name, then the wildcard, then the default
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if cert, ok := s.names[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed certificate of the names, returns its config
+func writeTestCert(t *testing.T, dir string, name string, dnsNames ...string) CertificateConfig {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	config := CertificateConfig{
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	os.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return config
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	configs := []CertificateConfig{
+		writeTestCert(t, dir, "default", "example.com"),
+		writeTestCert(t, dir, "wildcard", "*.example.org", "example.org"),
+		writeTestCert(t, dir, "exact", "www.example.org"),
+	}
+	store, err := NewCertStore(configs)
+	assert.NoError(t, err)
+
+	subject := func(serverName string) string {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		assert.NoError(t, err)
+		return cert.Leaf.Subject.CommonName
+	}
+	assert.Equal(t, "default", subject("example.com"))
+	assert.Equal(t, "wildcard", subject("Blog.Example.org."))
+	assert.Equal(t, "wildcard", subject("example.org"))
+	assert.Equal(t, "exact", subject("www.example.org"))
+	assert.Equal(t, "default", subject("a.b.example.org"))
+	assert.Equal(t, "default", subject(""))
+
+	changed, err := store.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// replaced on disk
+	writeTestCert(t, dir, "exact", "www.example.org", "api.example.org")
+	changed, err = store.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "exact", subject("api.example.org"))
+
+	// broken files keep the loaded
+	os.WriteFile(configs[2].KeyFile, []byte("broken"), 0600)
+	_, err = store.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "exact", subject("api.example.org"))
+
+	_, err = NewCertStore(nil)
+	assert.EqualError(t, err, "no certificate configured")
+}
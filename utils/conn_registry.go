@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnCredential the token a connection is authenticated by, so it is torn down when the token is revoked
+type ConnCredential struct {
+	Fingerprint string    // of the token
+	IssuedAt    time.Time // zero if the token carries no issue time
+	Backend     bool      // issued by the OAuth backend, which the issued before cutoff applies to
+}
+
+// ActiveConn is a proxied connection (tunnel or HTTP request) in progress
+type ActiveConn struct {
+	ID         uint64
+	User       string
+	Credential *ConnCredential // nil if not authenticated by a token, e.g. client certificate
+	Client     string          // the address of the client, the real one behind the trusted proxies
+	Dest       string
+	Start      time.Time
+	close      func()
+	upload     atomic.Int64
+	download   atomic.Int64
+}
+
+// ActiveConnInfo a snapshot of ActiveConn
+type ActiveConnInfo struct {
+	ID       uint64    `json:"id"`
+	User     string    `json:"user"`
+	Client   string    `json:"client"`
+	Dest     string    `json:"dest"`
+	Start    time.Time `json:"start"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// UploadWriter counts the bytes written to w as uploaded
+func (a *ActiveConn) UploadWriter(w io.Writer) io.Writer {
+	return &countingWriter{w, &a.upload}
+}
+
+// DownloadWriter counts the bytes written to w as downloaded
+func (a *ActiveConn) DownloadWriter(w io.Writer) io.Writer {
+	return &countingWriter{w, &a.download}
+}
+
+// Info a snapshot of the connection
+func (a *ActiveConn) Info() ActiveConnInfo {
+	return ActiveConnInfo{
+		ID:       a.ID,
+		User:     a.User,
+		Client:   a.Client,
+		Dest:     a.Dest,
+		Start:    a.Start,
+		Upload:   a.upload.Load(),
+		Download: a.download.Load(),
+	}
+}
+
+// ConnRegistry keeps track of the active connections, so that they can be torn down
+type ConnRegistry struct {
+	l     sync.Mutex
+	seq   uint64
+	conns map[uint64]*ActiveConn
+}
+
+// NewConnRegistry a ConnRegistry
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[uint64]*ActiveConn)}
+}
+
+// Add a connection of the client, close should make the proxying of it return
+func (c *ConnRegistry) Add(user string, credential *ConnCredential, client string, dest string, close func()) *ActiveConn {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.seq++
+	conn := &ActiveConn{
+		ID:         c.seq,
+		User:       user,
+		Credential: credential,
+		Client:     client,
+		Dest:       dest,
+		Start:      time.Now(),
+		close:      close,
+	}
+	c.conns[conn.ID] = conn
+	return conn
+}
+
+// Remove the connection when it is done
+func (c *ConnRegistry) Remove(conn *ActiveConn) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	delete(c.conns, conn.ID)
+}
+
+// List the active connections, ordered by ID
+func (c *ConnRegistry) List() []ActiveConnInfo {
+	c.l.Lock()
+	infos := make([]ActiveConnInfo, 0, len(c.conns))
+	for _, conn := range c.conns {
+		infos = append(infos, conn.Info())
+	}
+	c.l.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Close the connection of id, returns if it is found
+func (c *ConnRegistry) Close(id uint64) bool {
+	c.l.Lock()
+	conn, ok := c.conns[id]
+	c.l.Unlock()
+	if ok {
+		conn.close()
+	}
+	return ok
+}
+
+// CloseMatched closes the connections matched, returns the count closed
+func (c *ConnRegistry) CloseMatched(match func(conn *ActiveConn) bool) int {
+	c.l.Lock()
+	matched := make([]*ActiveConn, 0)
+	for _, conn := range c.conns {
+		if match(conn) {
+			matched = append(matched, conn)
+		}
+	}
+	c.l.Unlock()
+	for _, conn := range matched {
+		conn.close()
+	}
+	return len(matched)
+}
+
+// CloseUser closes all the connections of user, returns the count closed
+func (c *ConnRegistry) CloseUser(user string) int {
+	return c.CloseMatched(func(conn *ActiveConn) bool {
+		return conn.User == user
+	})
+}
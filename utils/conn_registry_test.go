@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnRegistry(t *testing.T) {
+	r := NewConnRegistry()
+	closed := map[string]int{}
+
+	a := r.Add("user", nil, "192.0.2.1:1234", "a.com:443", func() { closed["a"]++ })
+	r.Add("user", nil, "192.0.2.1:1234", "b.com:443", func() { closed["b"]++ })
+	r.Add("user2", nil, "192.0.2.1:1234", "c.com:443", func() { closed["c"]++ })
+	assert.NotEqual(t, a.ID, uint64(0))
+
+	r.Remove(a)
+	assert.Equal(t, 1, r.CloseUser("user"))
+	assert.Equal(t, map[string]int{"b": 1}, closed)
+
+	assert.Equal(t, 0, r.CloseUser("nobody"))
+
+	r.Add("user3", &ConnCredential{Fingerprint: "f1"}, "192.0.2.1:1234", "d.com:443", func() { closed["d"]++ })
+	assert.Equal(t, 1, r.CloseMatched(func(conn *ActiveConn) bool {
+		return conn.Credential != nil && conn.Credential.Fingerprint == "f1"
+	}))
+	assert.Equal(t, 1, closed["d"])
+}
+
+func TestConnRegistryList(t *testing.T) {
+	r := NewConnRegistry()
+	closed := false
+	a := r.Add("user", nil, "192.0.2.1:1234", "a.com:443", func() { closed = true })
+	b := r.Add("user2", nil, "192.0.2.1:1234", "b.com:443", func() {})
+
+	a.UploadWriter(io.Discard).Write([]byte("hello"))
+	a.DownloadWriter(io.Discard).Write([]byte("hi"))
+	infos := r.List()
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, a.ID, infos[0].ID)
+		assert.Equal(t, "192.0.2.1:1234", infos[0].Client)
+		assert.Equal(t, "a.com:443", infos[0].Dest)
+		assert.Equal(t, int64(5), infos[0].Upload)
+		assert.Equal(t, int64(2), infos[0].Download)
+		assert.Equal(t, b.ID, infos[1].ID)
+	}
+
+	assert.True(t, r.Close(a.ID))
+	assert.True(t, closed)
+	r.Remove(b)
+	assert.False(t, r.Close(b.ID))
+}
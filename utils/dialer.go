@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DialerConfig of the outbound connections
+type DialerConfig struct {
+	Timeout       time.Duration `yaml:"timeout"`        // default 10 seconds
+	KeepAlive     time.Duration `yaml:"keep_alive"`     // default 15 seconds, negative disables it
+	IPPreference  string        `yaml:"ip_preference"`  // ipv4, ipv6, ipv4_only or ipv6_only, default by the system
+	BindAddresses []string      `yaml:"bind_addresses"` // the source IPs, used in round robin
+	Mark          int           `yaml:"mark"`           // SO_MARK for policy routing, Linux only
+	DenyNetworks  []string      `yaml:"deny_networks"`  // the destinations denied after resolution, in CIDR
+}
+
+// ErrDestinationDenied the destination is in the deny networks
+var ErrDestinationDenied = errors.New("destination denied")
+
+// the address families to dial in order, interleaved if both, by the resolver if not specified
+var ipPreferenceNetworks = map[string][]string{
+	"":          nil,
+	"ipv4":      {"tcp4", "tcp6"},
+	"ipv6":      {"tcp6", "tcp4"},
+	"ipv4_only": {"tcp4"},
+	"ipv6_only": {"tcp6"},
+}
+
+type dialerPool struct {
+	dialers []*net.Dialer
+	next    atomic.Uint64
+}
+
+func (p *dialerPool) pick() *net.Dialer {
+	return p.dialers[(p.next.Add(1)-1)%uint64(len(p.dialers))]
+}
+
+// Dialer dials TCP connections with the source IPs and options configured,
+// the host names are resolved by the resolver, and the addresses are dialed in happy eyeballs.
+type Dialer struct {
+	timeout      time.Duration
+	networks     []string
+	pools        map[string]*dialerPool // by network, tcp4 / tcp6, so the source IPs only dial the destinations of their family
+	resolver     *Resolver
+	denyNetworks []netip.Prefix
+}
+
+// connectionAttemptDelay before trying the next address, see RFC 8305
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// NewDialer a Dialer
+func NewDialer(config DialerConfig, resolver *Resolver) (*Dialer, error) {
+	networks, ok := ipPreferenceNetworks[config.IPPreference]
+	if !ok {
+		return nil, errors.New("unknown ip preference: " + config.IPPreference)
+	}
+	if config.Mark != 0 && !markSupported {
+		return nil, errors.New("mark is only supported on Linux")
+	}
+	d := &Dialer{
+		timeout:  config.Timeout,
+		networks: networks,
+		pools:    map[string]*dialerPool{"tcp4": {}, "tcp6": {}},
+		resolver: resolver,
+	}
+	for _, network := range config.DenyNetworks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		d.denyNetworks = append(d.denyNetworks, prefix.Masked())
+	}
+	if d.timeout <= 0 {
+		d.timeout = 10 * time.Second
+	}
+	newDialer := func(localAddr net.Addr) *net.Dialer {
+		dialer := &net.Dialer{
+			Timeout:   d.timeout,
+			KeepAlive: config.KeepAlive,
+			LocalAddr: localAddr,
+		}
+		if config.Mark != 0 {
+			dialer.Control = func(network, address string, c syscall.RawConn) error {
+				markErr := error(nil)
+				if err := c.Control(func(fd uintptr) {
+					markErr = setMark(fd, config.Mark)
+				}); err != nil {
+					return err
+				}
+				return markErr
+			}
+		}
+		return dialer
+	}
+	if len(config.BindAddresses) == 0 {
+		dialer := newDialer(nil)
+		for _, pool := range d.pools {
+			pool.dialers = []*net.Dialer{dialer}
+		}
+		return d, nil
+	}
+	for _, address := range config.BindAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address: %s", address)
+		}
+		dialer := newDialer(&net.TCPAddr{IP: ip})
+		if ip.To4() != nil {
+			d.pools["tcp4"].dialers = append(d.pools["tcp4"].dialers, dialer)
+		} else {
+			d.pools["tcp6"].dialers = append(d.pools["tcp6"].dialers, dialer)
+		}
+	}
+	return d, nil
+}
+
+// DialContext dials addr in the preferred IP versions, network is ignored except tcp4 / tcp6
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err = d.candidates(network, addrs)
+	if err != nil {
+		return nil, err
+	}
+	return d.dialParallel(ctx, addrs, port)
+}
+
+func (d *Dialer) isDenied(addr netip.Addr) bool {
+	for _, prefix := range d.denyNetworks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDenied resolves the host of addr dialed through a next hop, which resolves it on its own,
+// ErrDestinationDenied if any of the addresses is in the deny networks. The hosts not resolved here
+// are left to the next hop.
+func (d *Dialer) checkDenied(ctx context.Context, addr string) error {
+	if len(d.denyNetworks) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	addrs, _ := d.resolver.LookupNetIP(ctx, host)
+	for _, a := range addrs {
+		if d.isDenied(a) {
+			return ErrDestinationDenied
+		}
+	}
+	return nil
+}
+
+func addrNetwork(addr netip.Addr) string {
+	if addr.Is4() {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// candidates the addresses to dial in order, the denied and the ones without bind address are removed
+func (d *Dialer) candidates(network string, addrs []netip.Addr) ([]netip.Addr, error) {
+	networks := d.networks
+	if network == "tcp4" || network == "tcp6" {
+		networks = []string{network}
+	}
+	if networks == nil && len(addrs) > 0 {
+		networks = []string{"tcp4", "tcp6"}
+		if addrs[0].Is6() {
+			networks = []string{"tcp6", "tcp4"}
+		}
+	}
+	err := error(nil)
+	byNetwork := make(map[string][]netip.Addr)
+	for _, addr := range addrs {
+		if d.isDenied(addr) {
+			err = ErrDestinationDenied
+			continue
+		}
+		byNetwork[addrNetwork(addr)] = append(byNetwork[addrNetwork(addr)], addr)
+	}
+	lists := make([][]netip.Addr, 0, 2)
+	for _, n := range networks {
+		if len(byNetwork[n]) == 0 {
+			continue
+		}
+		if len(d.pools[n].dialers) == 0 {
+			err = fmt.Errorf("no bind address for %s", n)
+			continue
+		}
+		lists = append(lists, byNetwork[n])
+	}
+	// interleave the address families
+	result := make([]netip.Addr, 0, len(addrs))
+	for i := 0; len(result) < len(addrs); i++ {
+		added := false
+		for _, list := range lists {
+			if i < len(list) {
+				result = append(result, list[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	if len(result) == 0 {
+		if err == nil {
+			err = errors.New("no address to dial")
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// dialParallel starts dialing the next address if the previous one fails or is slow, the first connected wins
+func (d *Dialer) dialParallel(ctx context.Context, addrs []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			n := addrNetwork(addr)
+			conn, err := d.pools[n].pick().DialContext(ctx, n, net.JoinHostPort(addr.String(), port))
+			select {
+			case results <- result{conn, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+	start()
+	err := error(nil)
+	for pending > 0 {
+		delay := (<-chan time.Time)(nil)
+		if next < len(addrs) {
+			delay = time.After(connectionAttemptDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, err
+}
+
+// Dial is DialContext without context
+func (d *Dialer) Dial(network string, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialErrorClass the class of the dial error for the metrics:
+// denied, timeout, dns, refused, reset, unreachable, canceled or other
+func DialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrDestinationDenied):
+		return "denied"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	}
+	return "other"
+}
@@ -0,0 +1,9 @@
+package utils
+
+import "syscall"
+
+const markSupported = true
+
+func setMark(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
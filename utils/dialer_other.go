@@ -0,0 +1,11 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+const markSupported = false
+
+func setMark(fd uintptr, mark int) error {
+	return errors.New("mark is only supported on Linux")
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialerBindAddresses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	sources := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			sources <- host
+			conn.Close()
+		}
+	}()
+
+	resolver, _ := NewResolver(ResolverConfig{})
+	d, err := NewDialer(DialerConfig{BindAddresses: []string{"127.0.0.2", "127.0.0.3", "::1"}, IPPreference: "ipv4"}, resolver)
+	assert.NoError(t, err)
+	for range 2 {
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	// round robin among the IPv4 bind addresses
+	assert.ElementsMatch(t, []string{"127.0.0.2", "127.0.0.3"}, []string{<-sources, <-sources})
+
+	// no IPv6 destination
+	_, err = d.Dial("tcp6", ln.Addr().String())
+	assert.Error(t, err)
+
+	d, err = NewDialer(DialerConfig{BindAddresses: []string{"::1"}, IPPreference: "ipv4_only"}, resolver)
+	assert.NoError(t, err)
+	_, err = d.Dial("tcp", ln.Addr().String())
+	assert.EqualError(t, err, "no bind address for tcp4")
+}
+
+func TestDialerIPv4OnlyDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	sources := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			sources <- host
+			conn.Close()
+		}
+	}()
+
+	// with the default preference, the IPv6 bind address is never used for the IPv4 destination
+	resolver, _ := NewResolver(ResolverConfig{})
+	d, err := NewDialer(DialerConfig{BindAddresses: []string{"::1", "127.0.0.2"}}, resolver)
+	assert.NoError(t, err)
+	for range 4 {
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if assert.NoError(t, err) {
+			conn.Close()
+			assert.Equal(t, "127.0.0.2", <-sources)
+		}
+	}
+
+	d, err = NewDialer(DialerConfig{BindAddresses: []string{"::1"}}, resolver)
+	assert.NoError(t, err)
+	_, err = d.Dial("tcp", ln.Addr().String())
+	assert.EqualError(t, err, "no bind address for tcp4")
+}
+
+func TestDialerConfigInvalid(t *testing.T) {
+	_, err := NewDialer(DialerConfig{IPPreference: "ipv5"}, nil)
+	assert.EqualError(t, err, "unknown ip preference: ipv5")
+	_, err = NewDialer(DialerConfig{BindAddresses: []string{"not-an-ip"}}, nil)
+	assert.EqualError(t, err, "invalid bind address: not-an-ip")
+}
+
+func TestDialerHappyEyeballsAndDeny(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	resolver, err := NewResolver(ResolverConfig{Hosts: map[string][]string{
+		"dual.test":    {"::1", "127.0.0.1"},
+		"private.test": {"10.0.0.1"},
+	}})
+	assert.NoError(t, err)
+	d, err := NewDialer(DialerConfig{DenyNetworks: []string{"10.0.0.0/8"}}, resolver)
+	assert.NoError(t, err)
+
+	// nothing is listening on ::1, falls back to 127.0.0.1
+	conn, err := d.Dial("tcp", "dual.test:"+port)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+		conn.Close()
+	}
+
+	_, err = d.Dial("tcp", "private.test:"+port)
+	assert.ErrorIs(t, err, ErrDestinationDenied)
+	_, err = d.Dial("tcp", "10.1.2.3:"+port)
+	assert.ErrorIs(t, err, ErrDestinationDenied)
+}
+
+func TestDialErrorClass(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err := net.Dial("tcp", addr)
+	assert.Equal(t, "refused", DialErrorClass(err))
+	_, err = net.Dial("tcp", "nonexistent.invalid:443")
+	assert.Equal(t, "dns", DialErrorClass(err))
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	assert.Equal(t, "timeout", DialErrorClass(err))
+	assert.Equal(t, "denied", DialErrorClass(fmt.Errorf("dial: %w", ErrDestinationDenied)))
+	assert.Equal(t, "other", DialErrorClass(errors.New("unknown")))
+}
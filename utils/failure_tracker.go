@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// FailureTrackerConfig of FailureTracker, the defaults are used for the zero values
+type FailureTrackerConfig struct {
+	Threshold     int           `yaml:"threshold"`      // failures in window to be blocked, default 10
+	Window        time.Duration `yaml:"window"`         // default 1 minute
+	BlockDuration time.Duration `yaml:"block_duration"` // default 15 minutes
+}
+
+type failureEntry struct {
+	count        int
+	windowStart  time.Time
+	blockedUntil time.Time
+}
+
+// FailureTracker counts the failures per key, e.g. source IP, and blocks the keys
+// failing too often for a while. A nil tracker blocks nothing.
+type FailureTracker struct {
+	config   FailureTrackerConfig
+	l        sync.Mutex
+	entries  map[string]*failureEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFailureTracker a FailureTracker
+func NewFailureTracker(config FailureTrackerConfig) (f *FailureTracker) {
+	if config.Threshold <= 0 {
+		config.Threshold = 10
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.BlockDuration <= 0 {
+		config.BlockDuration = 15 * time.Minute
+	}
+	f = &FailureTracker{
+		config:  config,
+		entries: make(map[string]*failureEntry),
+		stop:    make(chan struct{}),
+	}
+	go f.janitor()
+	return
+}
+
+// janitor prunes the entries every window
+func (f *FailureTracker) janitor() {
+	ticker := time.NewTicker(f.config.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case now := <-ticker.C:
+			f.prune(now)
+		}
+	}
+}
+
+// Stop the janitor
+func (f *FailureTracker) Stop() {
+	if f == nil {
+		return
+	}
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+func (f *FailureTracker) prune(now time.Time) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	for key, e := range f.entries {
+		if now.After(e.blockedUntil) && now.Sub(e.windowStart) > f.config.Window {
+			delete(f.entries, key)
+		}
+	}
+}
+
+// IsBlocked reports if key is blocked
+func (f *FailureTracker) IsBlocked(key string) bool {
+	if f == nil {
+		return false
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	e, ok := f.entries[key]
+	return ok && time.Now().Before(e.blockedUntil)
+}
+
+// Fail records a failure of key, returns true if key gets blocked by it
+func (f *FailureTracker) Fail(key string) bool {
+	if f == nil {
+		return false
+	}
+	now := time.Now()
+	f.l.Lock()
+	defer f.l.Unlock()
+	e, ok := f.entries[key]
+	if !ok {
+		e = &failureEntry{windowStart: now}
+		f.entries[key] = e
+	} else if now.Sub(e.windowStart) > f.config.Window {
+		e.count = 0
+		e.windowStart = now
+	}
+	e.count++
+	if e.count >= f.config.Threshold && now.After(e.blockedUntil) {
+		e.blockedUntil = now.Add(f.config.BlockDuration)
+		return true
+	}
+	return false
+}
+
+// Blocked the count of the keys blocked
+func (f *FailureTracker) Blocked() int {
+	if f == nil {
+		return 0
+	}
+	now := time.Now()
+	f.l.Lock()
+	defer f.l.Unlock()
+	n := 0
+	for _, e := range f.entries {
+		if now.Before(e.blockedUntil) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureTracker(t *testing.T) {
+	f := NewFailureTracker(FailureTrackerConfig{Threshold: 3, Window: time.Minute, BlockDuration: 200 * time.Millisecond})
+	defer f.Stop()
+
+	assert.False(t, f.Fail("1.2.3.4"))
+	assert.False(t, f.Fail("1.2.3.4"))
+	assert.False(t, f.IsBlocked("1.2.3.4"))
+	assert.True(t, f.Fail("1.2.3.4"))
+	assert.True(t, f.IsBlocked("1.2.3.4"))
+	assert.False(t, f.Fail("1.2.3.4")) // already blocked
+	assert.False(t, f.IsBlocked("5.6.7.8"))
+	assert.Equal(t, 1, f.Blocked())
+
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, f.IsBlocked("1.2.3.4"))
+	assert.Equal(t, 0, f.Blocked())
+
+	// failures out of the window are forgotten
+	f.prune(time.Now().Add(2 * time.Minute))
+	assert.False(t, f.Fail("1.2.3.4"))
+
+	var nilTracker *FailureTracker
+	assert.False(t, nilTracker.Fail("1.2.3.4"))
+	assert.False(t, nilTracker.IsBlocked("1.2.3.4"))
+	nilTracker.Stop()
+}
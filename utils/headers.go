@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// the hop-by-hop headers of RFC 9110, and the ones used by proxies in practice
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders removes the hop-by-hop headers, including the ones nominated by Connection
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// ViaDrop removes Via from the proxied messages
+const ViaDrop = "drop"
+
+// PrivacyConfig of the headers of the proxied HTTP requests, a nil PrivacyConfig keeps them as is
+type PrivacyConfig struct {
+	// Via is "drop" to remove it, or the pseudonym of the proxy to add to it, kept as is if empty
+	Via            string              `yaml:"via"`
+	StripForwarded bool                `yaml:"strip_forwarded"` // removes Forwarded and X-Forwarded-*
+	StripHeaders   []string            `yaml:"strip_headers"`   // removed for all users, e.g. X-Real-IP
+	UserHeaders    map[string][]string `yaml:"user_headers"`    // removed for the user, in addition
+}
+
+func (p *PrivacyConfig) via(header http.Header, protoMajor int, protoMinor int) {
+	switch p.Via {
+	case "":
+	case ViaDrop:
+		header.Del("Via")
+	default:
+		version := fmt.Sprintf("%d.%d", protoMajor, protoMinor)
+		if protoMajor >= 2 {
+			version = fmt.Sprintf("%d", protoMajor)
+		}
+		header.Add("Via", version+" "+p.Via)
+	}
+}
+
+// FilterRequest removes the headers of r identifying the user, and updates Via
+func (p *PrivacyConfig) FilterRequest(user string, r *http.Request) {
+	if p == nil {
+		return
+	}
+	p.via(r.Header, r.ProtoMajor, r.ProtoMinor)
+	if p.StripForwarded {
+		r.Header.Del("Forwarded")
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Forwarded-") {
+				r.Header.Del(name)
+			}
+		}
+	}
+	for _, name := range p.StripHeaders {
+		r.Header.Del(name)
+	}
+	for _, name := range p.UserHeaders[user] {
+		r.Header.Del(name)
+	}
+}
+
+// FilterResponse updates Via of resp
+func (p *PrivacyConfig) FilterResponse(resp *http.Response) {
+	if p == nil {
+		return
+	}
+	p.via(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+}
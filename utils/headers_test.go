@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":          {"keep-alive, X-Secret", "x-other"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"X-Secret":            {"1"},
+		"X-Other":             {"2"},
+		"Accept":              {"*/*"},
+	}
+	RemoveHopByHopHeaders(header)
+	assert.Equal(t, http.Header{"Accept": {"*/*"}}, header)
+}
+
+func TestPrivacyConfig(t *testing.T) {
+	newRequest := func() *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.Header = http.Header{
+			"Via":               {"1.1 client"},
+			"Forwarded":         {"for=192.0.2.1"},
+			"X-Forwarded-For":   {"192.0.2.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Real-Ip":         {"192.0.2.1"},
+			"X-Device-Id":       {"abc"},
+		}
+		return r
+	}
+
+	// nil keeps all
+	r := newRequest()
+	(*PrivacyConfig)(nil).FilterRequest("user@example.com", r)
+	assert.Len(t, r.Header, 6)
+
+	p := &PrivacyConfig{
+		Via:            "shp",
+		StripForwarded: true,
+		StripHeaders:   []string{"x-real-ip"},
+		UserHeaders:    map[string][]string{"user@example.com": {"X-Device-Id"}},
+	}
+	r = newRequest()
+	p.FilterRequest("user@example.com", r)
+	assert.Equal(t, http.Header{"Via": {"1.1 client", "1.1 shp"}}, r.Header)
+
+	r = newRequest()
+	p.FilterRequest("other@example.com", r)
+	assert.Equal(t, "abc", r.Header.Get("X-Device-Id"))
+
+	resp := &http.Response{Header: http.Header{}, ProtoMajor: 2}
+	p.FilterResponse(resp)
+	assert.Equal(t, "2 shp", resp.Header.Get("Via"))
+
+	p = &PrivacyConfig{Via: ViaDrop}
+	r = newRequest()
+	p.FilterRequest("user@example.com", r)
+	assert.Empty(t, r.Header.Get("Via"))
+	assert.NotEmpty(t, r.Header.Get("X-Forwarded-For"))
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// The server does not wrap the provider tokens any more, it issues the self-signed credentials,
+// which carry the ID of the key signing them. The keyring derives the keys of the credentials by
+// HKDF, and still decrypts the legacy tokens of EncryptAESGCM in the migration window.
+
+// AESKey is a secret identified by ID, the ID is derived from the secret if empty
+type AESKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret" redact:"secret"`
+}
+
+// Keyring holds the keys in order, the first one is active to sign, the others are verify only
+type Keyring struct {
+	secrets      map[string]string
+	ids          []string
+	acceptLegacy bool
+}
+
+// DeriveKeyID derives a short key ID from secret
+func DeriveKeyID(secret string) string {
+	key, _ := hkdf.Key(sha256.New, []byte(secret), nil, "go-shp key id", 32)
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:4])
+}
+
+// NewKeyring a Keyring, the first key is the active one.
+// acceptLegacy allows the legacy tokens to be decrypted by any of the keys.
+func NewKeyring(keys []AESKey, acceptLegacy bool) (*Keyring, error) {
+	k := &Keyring{
+		secrets:      make(map[string]string),
+		acceptLegacy: acceptLegacy,
+	}
+	for _, key := range keys {
+		if key.Secret == "" {
+			return nil, errors.New("empty secret in keyring")
+		}
+		id := key.ID
+		if id == "" {
+			id = DeriveKeyID(key.Secret)
+		}
+		if strings.Contains(id, ".") {
+			return nil, errors.New("key id must not contain '.': " + id)
+		}
+		if _, ok := k.secrets[id]; ok {
+			return nil, errors.New("duplicated key id: " + id)
+		}
+		k.secrets[id] = key.Secret
+		k.ids = append(k.ids, id)
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("keyring is empty")
+	}
+	return k, nil
+}
+
+// ActiveKeyID the ID of the key to sign with
+func (k *Keyring) ActiveKeyID() string {
+	return k.ids[0]
+}
+
+// KeyIDs all the IDs in the keyring, active or verify only
+func (k *Keyring) KeyIDs() []string {
+	return k.ids
+}
+
+// DeriveKey derives a 32-byte key for purpose from the key of id
+func (k *Keyring) DeriveKey(id string, purpose string) ([]byte, error) {
+	secret, ok := k.secrets[id]
+	if !ok {
+		return nil, errors.New("unknown key id: " + id)
+	}
+	return hkdf.Key(sha256.New, []byte(secret), nil, purpose, 32)
+}
+
+// Decrypt a legacy token by any of the keys, if accepted
+func (k *Keyring) Decrypt(token string) (string, error) {
+	if !k.acceptLegacy {
+		return "", errors.New("legacy token is not accepted")
+	}
+	err := error(nil)
+	for _, id := range k.ids {
+		plaintext := ""
+		plaintext, err = DecryptAESGCM(token, k.secrets[id])
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring(t *testing.T) {
+	keyring, err := NewKeyring([]AESKey{{ID: "k2", Secret: "new-secret"}, {ID: "k1", Secret: "old-secret"}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", keyring.ActiveKeyID())
+	assert.Equal(t, []string{"k2", "k1"}, keyring.KeyIDs())
+
+	newKey, err := keyring.DeriveKey("k2", "purpose")
+	assert.NoError(t, err)
+	assert.Len(t, newKey, 32)
+	oldKey, _ := keyring.DeriveKey("k1", "purpose")
+	assert.NotEqual(t, newKey, oldKey)
+	otherPurpose, _ := keyring.DeriveKey("k2", "other purpose")
+	assert.NotEqual(t, newKey, otherPurpose)
+	_, err = keyring.DeriveKey("k3", "purpose")
+	assert.Error(t, err)
+
+	// legacy tokens of any key in the migration window
+	legacy := EncryptToken("SR:refresh-token", "old-secret")
+	raw, err := keyring.Decrypt(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, "SR:refresh-token", raw)
+	_, err = keyring.Decrypt(EncryptToken("SR:refresh-token", "unknown-secret"))
+	assert.Error(t, err)
+
+	strict, _ := NewKeyring([]AESKey{{ID: "k1", Secret: "old-secret"}}, false)
+	_, err = strict.Decrypt(legacy)
+	assert.Error(t, err)
+}
+
+func TestKeyringInvalid(t *testing.T) {
+	_, err := NewKeyring(nil, true)
+	assert.Error(t, err)
+	_, err = NewKeyring([]AESKey{{ID: "k1", Secret: ""}}, true)
+	assert.Error(t, err)
+	_, err = NewKeyring([]AESKey{{ID: "k1", Secret: "a"}, {ID: "k1", Secret: "b"}}, true)
+	assert.Error(t, err)
+	_, err = NewKeyring([]AESKey{{ID: "k.1", Secret: "a"}}, true)
+	assert.Error(t, err)
+
+	keyring, err := NewKeyring([]AESKey{{Secret: "a"}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, DeriveKeyID("a"), keyring.ActiveKeyID())
+}
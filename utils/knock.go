@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// knockStep the knocks change every minute
+const knockStep = time.Minute
+
+func knockAt(secret string, step int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(step, 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Knock the secret knock at t, the first 16 hex digits of HMAC-SHA256 of the unix minute
+func Knock(secret string, t time.Time) string {
+	return knockAt(secret, t.Unix()/int64(knockStep.Seconds()))
+}
+
+// VerifyKnock checks the knock of the time within window of now, window is 1 minute if not positive
+func VerifyKnock(secret string, knock string, now time.Time, window time.Duration) bool {
+	if window <= 0 {
+		window = knockStep
+	}
+	step := now.Unix() / int64(knockStep.Seconds())
+	steps := int64(window / knockStep)
+	for i := step - steps; i <= step+steps; i++ {
+		if hmac.Equal([]byte(knock), []byte(knockAt(secret, i))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnock(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	knock := Knock("secret", now)
+	assert.Len(t, knock, 16)
+	assert.True(t, VerifyKnock("secret", knock, now, 0))
+	assert.True(t, VerifyKnock("secret", knock, now.Add(time.Minute), 0))
+	assert.False(t, VerifyKnock("secret", knock, now.Add(3*time.Minute), 0))
+	assert.True(t, VerifyKnock("secret", knock, now.Add(3*time.Minute), 5*time.Minute))
+	assert.False(t, VerifyKnock("other", knock, now, 0))
+	assert.False(t, VerifyKnock("secret", "", now, 0))
+}
@@ -0,0 +1,395 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// DirectRoute dials the destination directly
+const DirectRoute = "DIRECT"
+
+// NextHopConfig an upstream proxy to chain to. URL is one of http://, https:// (HTTP CONNECT),
+// shp:// (another go-shp server, the same as https://) or socks5://, with the credential in user info.
+type NextHopConfig struct {
+	Name                string        `yaml:"name"`
+	URL                 string        `yaml:"url" redact:"userinfo"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"` // 0 disables health check
+	HealthCheckTarget   string        `yaml:"health_check_target"`   // host:port dialed through it, default 1.1.1.1:443
+}
+
+// OutboundRule routes the matched traffic, a rule without domains or users matches all of them
+type OutboundRule struct {
+	Domains []string `yaml:"domains"` // the domains and their subdomains
+	Users   []string `yaml:"users"`
+	// NextHops the first healthy one is used, DIRECT dials directly, which is the default
+	NextHops []string `yaml:"next_hops"`
+	// BindAddresses overrides the ones of dialer when dialing directly
+	BindAddresses []string `yaml:"bind_addresses"`
+}
+
+// OutboundConfig routes the traffic by the first matched rule, the unmatched are dialed directly
+type OutboundConfig struct {
+	Resolver ResolverConfig  `yaml:"resolver"`
+	Dialer   DialerConfig    `yaml:"dialer"`
+	NextHops []NextHopConfig `yaml:"next_hops"`
+	Rules    []OutboundRule  `yaml:"rules"`
+}
+
+type outboundRule struct {
+	OutboundRule
+	direct *nextHop // with the bind addresses of the rule
+}
+
+type nextHop struct {
+	name      string
+	logger    *Logger
+	dialer    proxy.ContextDialer
+	transport *http.Transport
+	healthy   atomic.Bool
+}
+
+// Outbound dials the destinations for the server, directly or through the next hops.
+// A nil Outbound dials everything directly.
+type Outbound struct {
+	timeout  time.Duration
+	direct   *nextHop
+	hops     map[string]*nextHop
+	rules    []outboundRule
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOutbound an Outbound, the health check of the next hops starts in background
+func NewOutbound(config OutboundConfig, logger *Logger) (*Outbound, error) {
+	resolver, err := NewResolver(config.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	directDialer, err := NewDialer(config.Dialer, resolver)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbound{
+		timeout: directDialer.timeout,
+		direct:  newNextHop(DirectRoute, directDialer, logger),
+		hops:    make(map[string]*nextHop),
+		stop:    make(chan struct{}),
+	}
+	for _, hopConfig := range config.NextHops {
+		if hopConfig.Name == "" || hopConfig.Name == DirectRoute {
+			return nil, fmt.Errorf("invalid next hop name: %q", hopConfig.Name)
+		}
+		if _, ok := o.hops[hopConfig.Name]; ok {
+			return nil, errors.New("duplicated next hop: " + hopConfig.Name)
+		}
+		dialer, err := newNextHopDialer(hopConfig.URL, directDialer)
+		if err != nil {
+			return nil, fmt.Errorf("next hop %s: %w", hopConfig.Name, err)
+		}
+		dialer = &denyingDialer{dialer, directDialer}
+		o.hops[hopConfig.Name] = newNextHop(hopConfig.Name, dialer, logger)
+	}
+	for _, rule := range config.Rules {
+		for _, name := range rule.NextHops {
+			if _, ok := o.hops[name]; !ok && name != DirectRoute {
+				return nil, errors.New("unknown next hop: " + name)
+			}
+		}
+		r := outboundRule{rule, o.direct}
+		// the hosts are matched in lower case
+		r.Domains = make([]string, len(rule.Domains))
+		for i, domain := range rule.Domains {
+			r.Domains[i] = strings.ToLower(strings.TrimSuffix(domain, "."))
+		}
+		if len(rule.BindAddresses) > 0 {
+			dialerConfig := config.Dialer
+			dialerConfig.BindAddresses = rule.BindAddresses
+			dialer, err := NewDialer(dialerConfig, resolver)
+			if err != nil {
+				return nil, err
+			}
+			r.direct = newNextHop(DirectRoute, dialer, logger)
+		}
+		o.rules = append(o.rules, r)
+	}
+	for _, hopConfig := range config.NextHops {
+		if hopConfig.HealthCheckInterval > 0 {
+			target := hopConfig.HealthCheckTarget
+			if target == "" {
+				target = "1.1.1.1:443"
+			}
+			go o.hops[hopConfig.Name].checkHealth(hopConfig.HealthCheckInterval, target, o.stop)
+		}
+	}
+	return o, nil
+}
+
+// Stop the health check of the next hops
+func (o *Outbound) Stop() {
+	if o == nil {
+		return
+	}
+	o.stopOnce.Do(func() { close(o.stop) })
+}
+
+func newNextHop(name string, dialer proxy.ContextDialer, logger *Logger) *nextHop {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if name != DirectRoute {
+		transport.Proxy = nil
+	}
+	hop := &nextHop{name: name, logger: logger, dialer: dialer, transport: transport}
+	hop.healthy.Store(true)
+	return hop
+}
+
+func (h *nextHop) checkHealth(interval time.Duration, target string, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.probe(target)
+		}
+	}
+}
+
+// probe the target through the next hop, the health is logged when changed
+func (h *nextHop) probe(target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	conn, err := h.dialer.DialContext(ctx, "tcp", target)
+	cancel()
+	if err == nil {
+		conn.Close()
+	}
+	if h.healthy.Swap(err == nil) != (err == nil) {
+		if err == nil {
+			h.logger.Info("Next hop %s is healthy again.\n", h.name)
+		} else {
+			h.logger.Error("Next hop %s is unhealthy: %s\n", h.name, err)
+		}
+	}
+}
+
+func newNextHopDialer(rawURL string, forward *Dialer) (proxy.ContextDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		auth := (*proxy.Auth)(nil)
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer), nil
+	case "http", "https", "shp":
+		d := &httpConnectDialer{addr: u.Host, forward: forward}
+		port := "80"
+		if u.Scheme != "http" {
+			port = "443"
+			d.tlsConfig = &tls.Config{ServerName: u.Hostname(), NextProtos: []string{"http/1.1"}}
+		}
+		if u.Port() == "" {
+			d.addr = net.JoinHostPort(u.Hostname(), port)
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+		return d, nil
+	}
+	return nil, errors.New("unsupported scheme: " + u.Scheme)
+}
+
+// denyingDialer applies the deny networks of the direct dialer to the destinations of a next hop
+type denyingDialer struct {
+	proxy.ContextDialer
+	direct *Dialer
+}
+
+func (d *denyingDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if err := d.direct.checkDenied(ctx, addr); err != nil {
+		return nil, err
+	}
+	return d.ContextDialer.DialContext(ctx, network, addr)
+}
+
+// httpConnectDialer dials through an HTTP proxy by CONNECT
+type httpConnectDialer struct {
+	addr          string
+	tlsConfig     *tls.Config // nil for plain HTTP
+	authorization string
+	forward       proxy.ContextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.authorization != "" {
+		req.Header.Set("Proxy-Authorization", d.authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("next hop %s returned %s", d.addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn a net.Conn with the bytes read ahead
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// CloseWrite shuts down the writing side of conn if supported
+func CloseWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// CloseRead shuts down the reading side of conn if supported
+func CloseRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return nil
+}
+
+func matchDomain(domains []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// route the next hop for user to reach addr
+func (o *Outbound) route(user string, addr string) (*nextHop, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, rule := range o.rules {
+		if len(rule.Domains) > 0 && !matchDomain(rule.Domains, host) {
+			continue
+		}
+		if len(rule.Users) > 0 && !contains(rule.Users, user) {
+			continue
+		}
+		if len(rule.NextHops) == 0 {
+			return rule.direct, nil
+		}
+		for _, name := range rule.NextHops {
+			if name == DirectRoute {
+				return rule.direct, nil
+			}
+			if hop := o.hops[name]; hop.healthy.Load() {
+				return hop, nil
+			}
+		}
+		return nil, errors.New("no healthy next hop for " + addr)
+	}
+	return o.direct, nil
+}
+
+// DialContext dials addr for user
+func (o *Outbound) DialContext(ctx context.Context, user string, addr string) (net.Conn, error) {
+	if o == nil {
+		return (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", addr)
+	}
+	hop, err := o.route(user, addr)
+	if err != nil {
+		return nil, err
+	}
+	// the timeout covers the handshake with the next hop as well
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	return hop.dialer.DialContext(ctx, "tcp", addr)
+}
+
+// Transport the HTTP transport for user to reach addr
+func (o *Outbound) Transport(user string, addr string) (http.RoundTripper, error) {
+	if o == nil {
+		return http.DefaultTransport, nil
+	}
+	hop, err := o.route(user, addr)
+	if err != nil {
+		return nil, err
+	}
+	return hop.transport, nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"net/url"
+	"reflect"
+)
+
+// Redacted replaces the secrets in the redacted configs
+const Redacted = "******"
+
+// Redact returns a deep copy of config with the fields tagged by redact replaced, so the secrets added
+// later are redacted once tagged. Of the tags, "secret" replaces the strings, including the values of the
+// maps and the slices of strings, and "userinfo" replaces the userinfo of the URLs.
+func Redact[T any](config T) T {
+	return redactValue(reflect.ValueOf(&config).Elem(), "").Interface().(T)
+}
+
+func redactValue(v reflect.Value, tag string) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	out.Set(v)
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			out.SetString(redactString(v.String(), tag))
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			p := reflect.New(v.Type().Elem())
+			p.Elem().Set(redactValue(v.Elem(), tag))
+			out.Set(p)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.IsExported() {
+				out.Field(i).Set(redactValue(v.Field(i), field.Tag.Get("redact")))
+			}
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			for i := 0; i < v.Len(); i++ {
+				s.Index(i).Set(redactValue(v.Index(i), tag))
+			}
+			out.Set(s)
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			m := reflect.MakeMapWithSize(v.Type(), v.Len())
+			iter := v.MapRange()
+			for iter.Next() {
+				m.SetMapIndex(iter.Key(), redactValue(iter.Value(), tag))
+			}
+			out.Set(m)
+		}
+	}
+	return out
+}
+
+func redactString(s string, tag string) string {
+	switch tag {
+	case "secret":
+		return Redacted
+	case "userinfo":
+		u, err := url.Parse(s)
+		if err != nil {
+			return Redacted
+		}
+		if u.User != nil {
+			u.User = url.User(Redacted)
+		}
+		return u.String()
+	}
+	return s
+}
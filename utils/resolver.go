@@ -0,0 +1,377 @@
+package utils
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+// ResolverConfig of the DNS resolution for outbound connections
+type ResolverConfig struct {
+	// Upstreams are tried in order, one of udp://host:port, tcp://host:port, tls://host:port (DoT)
+	// or https://host/path (DoH), their host names are resolved by the system.
+	// The system resolver is used if empty.
+	Upstreams   []string            `yaml:"upstreams" redact:"userinfo"`
+	Hosts       map[string][]string `yaml:"hosts"`        // static overrides
+	Timeout     time.Duration       `yaml:"timeout"`      // per upstream or of the system resolver, default 5 seconds
+	MinTTL      time.Duration       `yaml:"min_ttl"`      // default 30 seconds, also for the system resolver
+	MaxTTL      time.Duration       `yaml:"max_ttl"`      // default 10 minutes
+	NegativeTTL time.Duration       `yaml:"negative_ttl"` // of the hosts not found, default 5 seconds, the other failures are not cached
+	CacheSize   int                 `yaml:"cache_size"`   // default 4096
+}
+
+type resolverCacheEntry struct {
+	host    string
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// Resolver resolves host names with cache
+type Resolver struct {
+	config    ResolverConfig
+	upstreams []*url.URL
+	hosts     map[string][]netip.Addr
+	client    *http.Client // for DoH
+	lookups   singleflight.Group
+	l         sync.Mutex
+	cache     map[string]*list.Element // of *resolverCacheEntry
+	lru       list.List                // of *resolverCacheEntry, the most recently used first
+}
+
+// NewResolver a Resolver
+func NewResolver(config ResolverConfig) (*Resolver, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.MinTTL <= 0 {
+		config.MinTTL = 30 * time.Second
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = 10 * time.Minute
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = 5 * time.Second
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = 4096
+	}
+	r := &Resolver{
+		config: config,
+		hosts:  make(map[string][]netip.Addr),
+		client: &http.Client{Timeout: config.Timeout},
+		cache:  make(map[string]*list.Element),
+	}
+	for _, upstream := range config.Upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "udp", "tcp", "tls", "https":
+		default:
+			return nil, errors.New("unsupported upstream: " + upstream)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	for host, ips := range config.Hosts {
+		for _, ip := range ips {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address of host %s: %s", host, ip)
+			}
+			key := strings.ToLower(host)
+			r.hosts[key] = append(r.hosts[key], addr)
+		}
+	}
+	return r, nil
+}
+
+// LookupNetIP resolves host to IPv4 and IPv6 addresses
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	if entry := r.get(host); entry != nil {
+		return entry.addrs, entry.err
+	}
+
+	// the concurrent lookups of host share one, which is not canceled by any of the callers
+	results := r.lookups.DoChan(host, func() (any, error) {
+		lookupCtx, span := StartSpan(context.WithoutCancel(ctx), "dns")
+		addrs, ttl, err := r.lookup(lookupCtx, host)
+		EndSpan(span, err)
+		entry := &resolverCacheEntry{host, addrs, err, time.Time{}}
+		switch {
+		case err == nil:
+			entry.expires = time.Now().Add(min(max(ttl, r.config.MinTTL), r.config.MaxTTL))
+		case errors.Is(err, errNoSuchHost):
+			entry.expires = time.Now().Add(r.config.NegativeTTL)
+		default:
+			// the upstreams may be back soon, the failures of them are not cached
+			return entry, nil
+		}
+		r.put(entry)
+		return entry, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		entry := result.Val.(*resolverCacheEntry)
+		return entry.addrs, entry.err
+	}
+}
+
+// get the cached entry of host, nil if not cached or expired
+func (r *Resolver) get(host string) *resolverCacheEntry {
+	r.l.Lock()
+	defer r.l.Unlock()
+	e, ok := r.cache[host]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*resolverCacheEntry)
+	if time.Now().After(entry.expires) {
+		return nil
+	}
+	r.lru.MoveToFront(e)
+	return entry
+}
+
+// put the entry into cache, the least recently used is evicted if full
+func (r *Resolver) put(entry *resolverCacheEntry) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if e, ok := r.cache[entry.host]; ok {
+		e.Value = entry
+		r.lru.MoveToFront(e)
+		return
+	}
+	r.cache[entry.host] = r.lru.PushFront(entry)
+	if r.lru.Len() > r.config.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*resolverCacheEntry).host)
+	}
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if len(r.upstreams) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if dnsErr := (*net.DNSError)(nil); errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, 0, fmt.Errorf("lookup %s: %w", host, errNoSuchHost)
+		}
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		return addrs, 0, err
+	}
+	err := error(nil)
+	for _, upstream := range r.upstreams {
+		addrs, ttl := []netip.Addr(nil), time.Duration(0)
+		addrs, ttl, err = r.lookupUpstream(ctx, upstream, host)
+		if err == nil {
+			return addrs, ttl, nil
+		}
+	}
+	return nil, 0, err
+}
+
+var errNoSuchHost = errors.New("no such host")
+
+// lookupUpstream queries A and AAAA records of host in parallel
+func (r *Resolver) lookupUpstream(ctx context.Context, upstream *url.URL, host string) ([]netip.Addr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func() {
+			addrs, ttl, err := r.query(ctx, upstream, host, qtype)
+			results <- result{addrs, ttl, err}
+		}()
+	}
+	addrs, ttl, err := []netip.Addr(nil), time.Duration(0), error(nil)
+	for range 2 {
+		res := <-results
+		if res.err != nil {
+			// the host is not found only if neither of the queries failed otherwise
+			if err == nil || errors.Is(err, errNoSuchHost) {
+				err = res.err
+			}
+			continue
+		}
+		addrs = append(addrs, res.addrs...)
+		if ttl == 0 || (res.ttl > 0 && res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, ttl, nil
+	}
+	if err == nil {
+		err = errNoSuchHost
+	}
+	return nil, 0, fmt.Errorf("lookup %s: %w", host, err)
+}
+
+func (r *Resolver) query(ctx context.Context, upstream *url.URL, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	response := []byte(nil)
+	switch upstream.Scheme {
+	case "udp":
+		response, err = exchangeUDP(ctx, upstream.Host, packed)
+		if err == nil && len(response) > 2 && response[2]&0x02 != 0 { // truncated
+			response, err = exchangeStream(ctx, upstream.Host, packed, nil)
+		}
+	case "tcp":
+		response, err = exchangeStream(ctx, upstream.Host, packed, nil)
+	case "tls":
+		response, err = exchangeStream(ctx, upstream.Host, packed, &tls.Config{ServerName: upstream.Hostname()})
+	case "https":
+		response, err = r.exchangeHTTPS(ctx, upstream.String(), packed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(response); err != nil {
+		return nil, 0, err
+	}
+	if msg.ID != query.ID {
+		return nil, 0, errors.New("dns response id mismatched")
+	}
+	if msg.RCode == dnsmessage.RCodeNameError {
+		return nil, 0, errNoSuchHost
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, errors.New("dns response " + msg.RCode.String())
+	}
+	addrs, ttl := []netip.Addr(nil), time.Duration(0)
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA).Unmap())
+		default:
+			continue
+		}
+		answerTTL := time.Duration(answer.Header.TTL) * time.Second
+		if ttl == 0 || answerTTL < ttl {
+			ttl = answerTTL
+		}
+	}
+	return addrs, ttl, nil
+}
+
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeStream over TCP, or TLS if tlsConfig is not nil, the messages are prefixed by length
+func exchangeStream(ctx context.Context, addr string, query []byte, tlsConfig *tls.Config) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// exchangeHTTPS by RFC 8484
+func (r *Resolver) exchangeHTTPS(ctx context.Context, endpoint string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("doh returned " + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerDNS answers A / AAAA queries of example.test, and NXDOMAIN for the others
+func answerDNS(t *testing.T, query []byte) []byte {
+	msg := dnsmessage.Message{}
+	assert.NoError(t, msg.Unpack(query))
+	question := msg.Questions[0]
+	msg.Response = true
+	if question.Name.String() != "example.test." {
+		msg.RCode = dnsmessage.RCodeNameError
+	} else if question.Type == dnsmessage.TypeA {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}}
+	} else {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()},
+		}}
+	}
+	response, err := msg.Pack()
+	assert.NoError(t, err)
+	return response
+}
+
+// udpDNSStub answers by answerDNS after delay, returns the upstream URL and the count of queries received
+func udpDNSStub(t *testing.T, delay time.Duration) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, 1232)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			response := answerDNS(t, buf[:n])
+			time.AfterFunc(delay, func() { conn.WriteTo(response, addr) })
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String(), queries
+}
+
+func TestResolverUDP(t *testing.T) {
+	upstream, queries := udpDNSStub(t, 0)
+	r, err := NewResolver(ResolverConfig{Upstreams: []string{upstream}})
+	assert.NoError(t, err)
+	addrs, err := r.LookupNetIP(context.Background(), "Example.test")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}, addrs)
+	assert.Equal(t, int32(2), queries.Load())
+
+	// cached
+	_, err = r.LookupNetIP(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), queries.Load())
+
+	_, err = r.LookupNetIP(context.Background(), "missing.test")
+	assert.ErrorIs(t, err, errNoSuchHost)
+}
+
+func TestResolverCache(t *testing.T) {
+	upstream, queries := udpDNSStub(t, 100*time.Millisecond)
+	r, err := NewResolver(ResolverConfig{Upstreams: []string{upstream}, CacheSize: 2})
+	assert.NoError(t, err)
+
+	// the concurrent lookups share one
+	wg := sync.WaitGroup{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupNetIP(context.Background(), "example.test")
+			assert.NoError(t, err)
+			assert.Len(t, addrs, 2)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), queries.Load())
+
+	// a canceled caller does not cancel the lookup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.LookupNetIP(ctx, "a.test")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Eventually(t, func() bool { return r.get("a.test") != nil }, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, r.get("a.test").err, errNoSuchHost)
+
+	// the least recently used is evicted
+	r.LookupNetIP(context.Background(), "example.test")
+	r.LookupNetIP(context.Background(), "b.test")
+	assert.NotNil(t, r.get("example.test"))
+	assert.Nil(t, r.get("a.test"))
+	assert.Equal(t, 2, r.lru.Len())
+	assert.Equal(t, int32(6), queries.Load())
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	upstream, queries := udpDNSStub(t, 0)
+	r, err := NewResolver(ResolverConfig{Upstreams: []string{upstream}, NegativeTTL: 200 * time.Millisecond})
+	assert.NoError(t, err)
+
+	// the hosts not found are cached for negative_ttl
+	_, err = r.LookupNetIP(context.Background(), "missing.test")
+	assert.ErrorIs(t, err, errNoSuchHost)
+	_, err = r.LookupNetIP(context.Background(), "missing.test")
+	assert.ErrorIs(t, err, errNoSuchHost)
+	assert.Equal(t, int32(2), queries.Load())
+	time.Sleep(250 * time.Millisecond)
+	r.LookupNetIP(context.Background(), "missing.test")
+	assert.Equal(t, int32(4), queries.Load())
+
+	// the failures of the upstreams are not cached
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ln.Close()
+	r, err = NewResolver(ResolverConfig{Upstreams: []string{"tcp://" + ln.Addr().String()}})
+	assert.NoError(t, err)
+	_, err = r.LookupNetIP(context.Background(), "example.test")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errNoSuchHost)
+	assert.Nil(t, r.get("example.test"))
+}
+
+func TestResolverDoH(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerDNS(t, query))
+	}))
+	defer server.Close()
+
+	r, err := NewResolver(ResolverConfig{Upstreams: []string{server.URL + "/dns-query"}})
+	assert.NoError(t, err)
+	r.client = server.Client()
+	addrs, err := r.LookupNetIP(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 2)
+}
+
+func TestResolverHosts(t *testing.T) {
+	r, err := NewResolver(ResolverConfig{Hosts: map[string][]string{"Static.test": {"192.0.2.2"}}})
+	assert.NoError(t, err)
+	addrs, err := r.LookupNetIP(context.Background(), "static.test.")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2")}, addrs)
+
+	addrs, err = r.LookupNetIP(context.Background(), "::ffff:192.0.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.3")}, addrs)
+
+	_, err = NewResolver(ResolverConfig{Upstreams: []string{"quic://1.1.1.1"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed site
+var embeddedSite embed.FS
+
+// StaticSiteConfig serves the camouflage site from a directory, or the embedded default site
+type StaticSiteConfig struct {
+	Root       string        `yaml:"root"`        // the directory, the embedded default site if empty
+	IndexFiles []string      `yaml:"index_files"` // default index.html
+	NotFound   string        `yaml:"not_found"`   // the page of 404 relative to root, default 404.html if exists
+	MaxAge     time.Duration `yaml:"max_age"`     // of Cache-Control, default 1 hour
+}
+
+// StaticSite serves the files, the precompressed .br / .gz are served if accepted
+type StaticSite struct {
+	config StaticSiteConfig
+	files  fs.FS
+}
+
+// NewStaticSite a StaticSite
+func NewStaticSite(config StaticSiteConfig) (*StaticSite, error) {
+	files := fs.FS(nil)
+	if config.Root == "" {
+		files, _ = fs.Sub(embeddedSite, "site")
+	} else {
+		info, err := os.Stat(config.Root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New("static site root is not a directory: " + config.Root)
+		}
+		files = os.DirFS(config.Root)
+	}
+	if len(config.IndexFiles) == 0 {
+		config.IndexFiles = []string{"index.html"}
+	}
+	if config.NotFound == "" {
+		config.NotFound = "404.html"
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = time.Hour
+	}
+	return &StaticSite{config: config, files: files}, nil
+}
+
+// open the regular file of name, or the index file if name is a directory
+func (s *StaticSite) open(name string) (fs.File, fs.FileInfo, string) {
+	f, err := s.files.Open(name)
+	if err != nil {
+		return nil, nil, ""
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, ""
+	}
+	if info.Mode().IsRegular() {
+		return f, info, name
+	}
+	f.Close()
+	if !info.IsDir() {
+		return nil, nil, ""
+	}
+	for _, index := range s.config.IndexFiles {
+		if f, info, name := s.open(path.Join(name, index)); f != nil {
+			return f, info, name
+		}
+	}
+	return nil, nil, ""
+}
+
+// openPrecompressed the .br or .gz version of name if accepted by the client
+func (s *StaticSite) openPrecompressed(r *http.Request, name string) (fs.File, fs.FileInfo, string) {
+	accepted := r.Header.Get("Accept-Encoding")
+	for _, encoding := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+		if !strings.Contains(accepted, encoding.name) {
+			continue
+		}
+		if f, info, _ := s.open(name + encoding.ext); f != nil {
+			return f, info, encoding.name
+		}
+	}
+	return nil, nil, ""
+}
+
+func (s *StaticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	f, info, file := s.open(name)
+	if f == nil {
+		s.serveNotFound(w, r)
+		return
+	}
+	defer f.Close()
+	// the relative links of the index files work with the trailing slash only
+	// the target is built from the cleaned name, so "//evil.example/dir" does not redirect off site
+	if file != name && !strings.HasSuffix(r.URL.Path, "/") {
+		target := &url.URL{Path: "/", RawQuery: r.URL.RawQuery}
+		if name != "." {
+			target.Path = "/" + name + "/"
+		}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+	name = file
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.config.MaxAge.Seconds())))
+	w.Header().Set("Vary", "Accept-Encoding")
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if compressed, compressedInfo, encoding := s.openPrecompressed(r, name); compressed != nil {
+		defer compressed.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		f, info = compressed, compressedInfo
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+func (s *StaticSite) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	f, _, _ := s.open(s.config.NotFound)
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
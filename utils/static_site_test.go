@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticSite(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("home"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("docs"), 0644)
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("plain"), 0644)
+	os.WriteFile(filepath.Join(root, "app.js.br"), []byte("brotli"), 0644)
+	os.WriteFile(filepath.Join(root, "app.js.gz"), []byte("gzip"), 0644)
+	os.WriteFile(filepath.Join(root, "missing.html"), []byte("custom 404"), 0644)
+	site, err := NewStaticSite(StaticSiteConfig{Root: root, NotFound: "missing.html"})
+	assert.NoError(t, err)
+
+	get := func(method string, path string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		site.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(http.MethodGet, "/", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "home", w.Body.String())
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = get(http.MethodGet, "/docs", "")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/docs/", w.Header().Get("Location"))
+	assert.Equal(t, "docs", get(http.MethodGet, "/docs/", "").Body.String())
+	// not redirected off site
+	w = get(http.MethodGet, "//evil.example/../docs", "")
+	assert.Equal(t, "/docs/", w.Header().Get("Location"))
+	w = get(http.MethodGet, "/docs?lang=en", "")
+	assert.Equal(t, "/docs/?lang=en", w.Header().Get("Location"))
+	w = get(http.MethodGet, "/.", "")
+	assert.Equal(t, "/", w.Header().Get("Location"))
+
+	w = get(http.MethodGet, "/app.js", "gzip, deflate, br")
+	assert.Equal(t, "brotli", w.Body.String())
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Contains(t, w.Header().Get("Content-Type"), "javascript")
+	w = get(http.MethodGet, "/app.js", "gzip")
+	assert.Equal(t, "gzip", w.Body.String())
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	w = get(http.MethodGet, "/app.js", "")
+	assert.Equal(t, "plain", w.Body.String())
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	w = get(http.MethodGet, "/../../etc/passwd", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "custom 404", w.Body.String())
+
+	w = get(http.MethodPost, "/", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestStaticSiteEmbedded(t *testing.T) {
+	site, err := NewStaticSite(StaticSiteConfig{})
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	site.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<title>Notes</title>")
+
+	w = httptest.NewRecorder()
+	site.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/wp-login.php", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Not Found")
+
+	_, err = NewStaticSite(StaticSiteConfig{Root: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
@@ -1,58 +1,293 @@
 package utils
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// TokenCacheConfig of the cache of the token check results
+type TokenCacheConfig struct {
+	MaxSize      int           `yaml:"max_size"`      // the least recently used are evicted, default 100000
+	Shards       int           `yaml:"shards"`        // the locks, default 16
+	TTL          time.Duration `yaml:"ttl"`           // of the tokens checked, default 30 minutes
+	NegativeTTL  time.Duration `yaml:"negative_ttl"`  // of the tokens failed to check, default 3 minutes
+	SnapshotFile string        `yaml:"snapshot_file"` // loaded on start, saved every minute and on Stop, only the token hashes are saved
+}
+
+// the janitor removes the expired every second, and saves the snapshot every minute
+const (
+	tokenCacheSweepInterval = time.Second
+	tokenCacheSnapshotTicks = 60
+)
+
+type tokenKey [sha256.Size]byte
+
 type item struct {
+	key     tokenKey
 	email   string
 	expires time.Time
 }
 
-// TokenCache a Map with Time to Life
+type tokenCacheShard struct {
+	l       sync.Mutex
+	maxSize int
+	items   map[tokenKey]*list.Element
+	lru     list.List // of *item, the most recently used first
+}
+
+// TokenCache a sharded LRU cache with Time to Life, the tokens are kept by their SHA-256
 type TokenCache struct {
-	m map[string]*item
-	l sync.Mutex
-}
-
-// NewTokenCache a TokenCache
-func NewTokenCache() (t *TokenCache) {
-	t = &TokenCache{m: make(map[string]*item)}
-	go func() {
-		for now := range time.Tick(time.Second) {
-			t.l.Lock()
-			for k, v := range t.m {
-				if now.After(v.expires) {
-					delete(t.m, k)
-				}
+	config    TokenCacheConfig
+	shards    []*tokenCacheShard
+	evictions atomic.Uint64
+	dirty     atomic.Bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewTokenCache a TokenCache of the default config
+func NewTokenCache() *TokenCache {
+	t, _ := NewTokenCacheWithConfig(TokenCacheConfig{})
+	return t
+}
+
+// NewTokenCacheWithConfig a TokenCache, loaded from the snapshot file if it exists
+func NewTokenCacheWithConfig(config TokenCacheConfig) (*TokenCache, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100000
+	}
+	if config.Shards <= 0 {
+		config.Shards = 16
+	}
+	if config.TTL <= 0 {
+		config.TTL = 30 * time.Minute
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = 3 * time.Minute
+	}
+	t := &TokenCache{
+		config: config,
+		shards: make([]*tokenCacheShard, config.Shards),
+		stop:   make(chan struct{}),
+	}
+	for i := range t.shards {
+		t.shards[i] = &tokenCacheShard{
+			maxSize: max(1, config.MaxSize/config.Shards),
+			items:   make(map[tokenKey]*list.Element),
+		}
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	go t.janitor()
+	return t, nil
+}
+
+func (t *TokenCache) janitor() {
+	ticker := time.NewTicker(tokenCacheSweepInterval)
+	defer ticker.Stop()
+	for ticks := 1; ; ticks++ {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			for _, s := range t.shards {
+				s.sweep(now)
 			}
-			t.l.Unlock()
+			if ticks%tokenCacheSnapshotTicks == 0 {
+				t.saveIfDirty()
+			}
+		}
+	}
+}
+
+func (t *TokenCache) saveIfDirty() {
+	if t.config.SnapshotFile != "" && t.dirty.Swap(false) {
+		if err := t.Save(); err != nil {
+			t.dirty.Store(true)
+		}
+	}
+}
+
+// Stop the janitor, the snapshot is saved if configured
+func (t *TokenCache) Stop() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	if t.config.SnapshotFile == "" {
+		return nil
+	}
+	return t.Save()
+}
+
+// TTL of the tokens checked
+func (t *TokenCache) TTL() time.Duration {
+	return t.config.TTL
+}
+
+// NegativeTTL of the tokens failed to check
+func (t *TokenCache) NegativeTTL() time.Duration {
+	return t.config.NegativeTTL
+}
+
+// Evictions the count of the items evicted for the size cap
+func (t *TokenCache) Evictions() uint64 {
+	return t.evictions.Load()
+}
+
+func (t *TokenCache) shard(key tokenKey) *tokenCacheShard {
+	return t.shards[binary.BigEndian.Uint64(key[:8])%uint64(len(t.shards))]
+}
+
+// sweep removes the expired
+func (s *tokenCacheShard) sweep(now time.Time) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for key, e := range s.items {
+		if now.After(e.Value.(*item).expires) {
+			s.lru.Remove(e)
+			delete(s.items, key)
 		}
-	}()
-	return
+	}
+}
+
+// put an item, returns if one is evicted
+func (s *tokenCacheShard) put(it *item) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if e, ok := s.items[it.key]; ok {
+		e.Value = it
+		s.lru.MoveToFront(e)
+		return false
+	}
+	s.items[it.key] = s.lru.PushFront(it)
+	if s.lru.Len() <= s.maxSize {
+		return false
+	}
+	oldest := s.lru.Back()
+	s.lru.Remove(oldest)
+	delete(s.items, oldest.Value.(*item).key)
+	return true
 }
 
 // Len of the cache
 func (t *TokenCache) Len() int {
-	return len(t.m)
+	n := 0
+	for _, s := range t.shards {
+		s.l.Lock()
+		n += len(s.items)
+		s.l.Unlock()
+	}
+	return n
 }
 
-// Put an token into cache
+// Flush removes all the items, returns the count removed
+func (t *TokenCache) Flush() int {
+	n := 0
+	for _, s := range t.shards {
+		s.l.Lock()
+		n += len(s.items)
+		s.items = make(map[tokenKey]*list.Element)
+		s.lru.Init()
+		s.l.Unlock()
+	}
+	t.dirty.Store(true)
+	return n
+}
+
+// Put an token into cache, the existing one is replaced
 func (t *TokenCache) Put(token string, email string, ttl time.Duration) {
-	t.l.Lock()
-	defer t.l.Unlock()
-	if _, ok := t.m[token]; !ok {
-		t.m[token] = &item{email: email, expires: time.Now().Add(ttl)}
+	key := tokenKey(sha256.Sum256([]byte(token)))
+	if t.shard(key).put(&item{key: key, email: email, expires: time.Now().Add(ttl)}) {
+		t.evictions.Add(1)
 	}
+	t.dirty.Store(true)
 }
 
 // Get item from cache
 func (t *TokenCache) Get(token string) string {
-	t.l.Lock()
-	defer t.l.Unlock()
-	if it, ok := t.m[token]; ok {
-		return it.email
+	key := tokenKey(sha256.Sum256([]byte(token)))
+	s := t.shard(key)
+	s.l.Lock()
+	defer s.l.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return ""
+	}
+	it := e.Value.(*item)
+	if time.Now().After(it.expires) {
+		return ""
+	}
+	s.lru.MoveToFront(e)
+	return it.email
+}
+
+type tokenCacheSnapshotItem struct {
+	Hash    string    `json:"hash"`
+	Email   string    `json:"email"`
+	Expires time.Time `json:"expires"`
+}
+
+// Save the snapshot to the snapshot file
+func (t *TokenCache) Save() error {
+	if t.config.SnapshotFile == "" {
+		return errors.New("no snapshot file configured")
+	}
+	items := make([]tokenCacheSnapshotItem, 0)
+	now := time.Now()
+	for _, s := range t.shards {
+		s.l.Lock()
+		// the least recently used first, so they are evicted first after loading
+		for e := s.lru.Back(); e != nil; e = e.Prev() {
+			it := e.Value.(*item)
+			if it.expires.After(now) {
+				items = append(items, tokenCacheSnapshotItem{hex.EncodeToString(it.key[:]), it.email, it.expires})
+			}
+		}
+		s.l.Unlock()
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	tmp := t.config.SnapshotFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.config.SnapshotFile)
+}
+
+// load the snapshot file if it exists, the expired are skipped
+func (t *TokenCache) load() error {
+	if t.config.SnapshotFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(t.config.SnapshotFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	items := make([]tokenCacheSnapshotItem, 0)
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, snapshot := range items {
+		key := tokenKey{}
+		if n, err := hex.Decode(key[:], []byte(snapshot.Hash)); err != nil || n != len(key) {
+			return errors.New("invalid token hash in snapshot: " + snapshot.Hash)
+		}
+		if snapshot.Expires.After(now) {
+			t.shard(key).put(&item{key: key, email: snapshot.Email, expires: snapshot.Expires})
+		}
 	}
-	return ""
+	return nil
 }
@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -27,3 +30,73 @@ func Test_TokenCache(t *testing.T) {
 	assert.Equal(t, 0, c.Len())
 	assert.Equal(t, "", c.Get("token3"))
 }
+
+func Test_TokenCacheFlush(t *testing.T) {
+	c := NewTokenCache()
+	c.Put("token", "user", time.Minute)
+	c.Put("token2", "user2", time.Minute)
+
+	assert.Equal(t, 2, c.Flush())
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, "", c.Get("token"))
+}
+
+func Test_TokenCacheShards(t *testing.T) {
+	c, err := NewTokenCacheWithConfig(TokenCacheConfig{Shards: 1024})
+	assert.NoError(t, err)
+	defer c.Stop()
+	for i := 0; i < 4096; i++ {
+		c.Put(strconv.Itoa(i), "user", time.Minute)
+	}
+	// all the shards are used, not only the first 256
+	used := 0
+	for _, s := range c.shards {
+		if len(s.items) > 0 {
+			used++
+		}
+	}
+	assert.Greater(t, used, 900)
+}
+
+func Test_TokenCacheLRU(t *testing.T) {
+	c, err := NewTokenCacheWithConfig(TokenCacheConfig{MaxSize: 2, Shards: 1})
+	assert.NoError(t, err)
+	defer c.Stop()
+	c.Put("token", "user", time.Minute)
+	c.Put("token2", "user2", time.Minute)
+	assert.Equal(t, "user", c.Get("token"))
+	c.Put("token3", "user3", time.Minute)
+
+	// token2 is the least recently used
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, "", c.Get("token2"))
+	assert.Equal(t, "user", c.Get("token"))
+	assert.Equal(t, uint64(1), c.Evictions())
+
+	// replaced
+	c.Put("token", "err", time.Minute)
+	assert.Equal(t, "err", c.Get("token"))
+	assert.Equal(t, 30*time.Minute, c.TTL())
+	assert.Equal(t, 3*time.Minute, c.NegativeTTL())
+}
+
+func Test_TokenCacheSnapshot(t *testing.T) {
+	config := TokenCacheConfig{SnapshotFile: filepath.Join(t.TempDir(), "tokens.json")}
+	c, err := NewTokenCacheWithConfig(config)
+	assert.NoError(t, err)
+	c.Put("token", "user", time.Minute)
+	c.Put("expired", "user", -time.Second)
+	assert.NoError(t, c.Stop())
+
+	data, _ := os.ReadFile(config.SnapshotFile)
+	assert.NotContains(t, string(data), "token")
+	c, err = NewTokenCacheWithConfig(config)
+	assert.NoError(t, err)
+	defer c.Stop()
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, "user", c.Get("token"))
+
+	os.WriteFile(config.SnapshotFile, []byte(`[{"hash":"broken"}]`), 0600)
+	_, err = NewTokenCacheWithConfig(config)
+	assert.Error(t, err)
+}
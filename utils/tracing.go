@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptrace"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/winguse/go-shp"
+
+// TracingConfig exports the spans by OTLP over HTTP
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint" redact:"userinfo"` // the URL of the traces, e.g. http://127.0.0.1:4318/v1/traces
+	Headers     map[string]string `yaml:"headers" redact:"secret"`    // sent to the collector, e.g. the API key
+	SampleRatio float64           `yaml:"sample_ratio"`               // of the traces, default 1
+	ServiceName string            `yaml:"service_name"`               // default go-shp
+	Redact      bool              `yaml:"redact"`                     // hashes the user and destination attributes with redact_key
+	RedactKey   string            `yaml:"redact_key" redact:"secret"` // the secret of the HMAC, required if redact
+}
+
+// Tracing the spans exported, a nil Tracing disables tracing
+type Tracing struct {
+	provider  *sdktrace.TracerProvider
+	redactKey []byte // nil if not redacted
+}
+
+// NewTracing a Tracing, it is set as the global tracer provider used by StartSpan
+func NewTracing(config TracingConfig) (*Tracing, error) {
+	if config.Redact && config.RedactKey == "" {
+		return nil, errors.New("redact_key is required to redact")
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.Endpoint),
+		otlptracehttp.WithHeaders(config.Headers),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ratio := config.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "go-shp"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	t := &Tracing{provider: provider}
+	if config.Redact {
+		t.redactKey = []byte(config.RedactKey)
+	}
+	return t, nil
+}
+
+// Shutdown exports the spans pending
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// shutdown exports the spans pending, waits no more than 5 seconds for the collector
+func (t *Tracing) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t.Shutdown(ctx)
+}
+
+// Fatal exports the spans pending before log.Fatal, which exits without running the deferred calls
+func (t *Tracing) Fatal(v ...interface{}) {
+	t.shutdown()
+	log.Fatal(v...)
+}
+
+// ShutdownOnSignal exports the spans pending and exits on SIGINT or SIGTERM
+func (t *Tracing) ShutdownOnSignal() {
+	if t == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		t.shutdown()
+		os.Exit(0)
+	}()
+}
+
+// value v, or the first 16 hex digits of its HMAC-SHA256 by the redact key if redacted
+func (t *Tracing) value(v string) string {
+	if t == nil || t.redactKey == nil {
+		return v
+	}
+	mac := hmac.New(sha256.New, t.redactKey)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// User the attribute of the user
+func (t *Tracing) User(user string) attribute.KeyValue {
+	return attribute.String("shp.user", t.value(user))
+}
+
+// Destination the attribute of the destination host
+func (t *Tracing) Destination(dest string) attribute.KeyValue {
+	return attribute.String("shp.destination", t.value(dest))
+}
+
+// WithClientTrace records the DNS lookups, connecting, TLS handshakes and the first response byte
+// of the dials and HTTP requests in ctx, as the child spans of the span in ctx
+func (t *Tracing) WithClientTrace(ctx context.Context) context.Context {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx
+	}
+	l := sync.Mutex{}
+	spans := make(map[string]trace.Span)
+	start := func(key string, name string, attrs ...attribute.KeyValue) {
+		_, span := StartSpan(ctx, name, attrs...)
+		l.Lock()
+		defer l.Unlock()
+		spans[key] = span
+	}
+	end := func(key string, err error) {
+		l.Lock()
+		span, ok := spans[key]
+		delete(spans, key)
+		l.Unlock()
+		if ok {
+			EndSpan(span, err)
+		}
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			start("dns", "dns", t.Destination(info.Host))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			end("dns", info.Err)
+		},
+		ConnectStart: func(network string, addr string) {
+			start("connect "+addr, "connect", attribute.String("shp.address", t.value(addr)))
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			end("connect "+addr, err)
+		},
+		TLSHandshakeStart: func() {
+			start("tls", "tls_handshake")
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			end("tls", err)
+		},
+		WroteHeaders: func() {
+			start("first_byte", "first_byte")
+		},
+		GotFirstResponseByte: func() {
+			end("first_byte", nil)
+		},
+	})
+}
+
+// StartSpan a span of the phase, the child of the span in ctx if any, no-op if tracing is disabled
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends the span with the error if any
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type firstByteReader struct {
+	r    io.Reader
+	span trace.Span
+	done bool
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if !f.done && (n > 0 || err != nil) {
+		f.done = true
+		if n > 0 {
+			f.span.End()
+		} else {
+			EndSpan(f.span, err)
+		}
+	}
+	return n, err
+}
+
+// FirstByteReader records the span till the first byte read from r, r is returned if not traced
+func FirstByteReader(ctx context.Context, r io.Reader) io.Reader {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return r
+	}
+	_, span := StartSpan(ctx, "first_byte")
+	return &firstByteReader{r: r, span: span}
+}
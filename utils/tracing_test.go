@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStub receives the spans exported, returns the names of the spans with their attributes
+func collectorStub(t *testing.T) (*httptest.Server, func() map[string]map[string]string) {
+	l := sync.Mutex{}
+	spans := make(map[string]map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := &collectortrace.ExportTraceServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(body, request))
+		l.Lock()
+		defer l.Unlock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					attrs := make(map[string]string)
+					for _, attr := range span.Attributes {
+						attrs[attr.Key] = attr.Value.GetStringValue()
+					}
+					if span.Status != nil && span.Status.Message != "" {
+						attrs["error"] = span.Status.Message
+					}
+					spans[span.Name] = attrs
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(nil)
+	}))
+	return server, func() map[string]map[string]string {
+		l.Lock()
+		defer l.Unlock()
+		return spans
+	}
+}
+
+func TestTracing(t *testing.T) {
+	collector, spans := collectorStub(t)
+	defer collector.Close()
+	_, err := NewTracing(TracingConfig{Endpoint: collector.URL + "/v1/traces", Redact: true})
+	assert.Error(t, err)
+	other, err := NewTracing(TracingConfig{Endpoint: collector.URL + "/v1/traces", Redact: true, RedactKey: "other"})
+	assert.NoError(t, err)
+	other.Shutdown(context.Background())
+	tracing, err := NewTracing(TracingConfig{Endpoint: collector.URL + "/v1/traces", Redact: true, RedactKey: "secret"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, other.value("user@example.com"), tracing.value("user@example.com"))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	ctx, span := StartSpan(context.Background(), "request", tracing.User("user@example.com"))
+	req, _ := http.NewRequestWithContext(tracing.WithClientTrace(ctx), http.MethodGet, upstream.URL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	server, client := net.Pipe()
+	go func() {
+		server.Write([]byte("hi"))
+		server.Close()
+	}()
+	io.ReadAll(FirstByteReader(ctx, client))
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerDNS(t, query))
+	}))
+	defer doh.Close()
+	resolver, err := NewResolver(ResolverConfig{Upstreams: []string{doh.URL}})
+	assert.NoError(t, err)
+	resolver.client = doh.Client()
+	_, err = resolver.LookupNetIP(ctx, "example.test")
+	assert.NoError(t, err)
+	_, dial := StartSpan(ctx, "dial")
+	EndSpan(dial, errors.New("connection refused"))
+	span.End()
+	assert.NoError(t, tracing.Shutdown(context.Background()))
+
+	exported := spans()
+	for _, name := range []string{"request", "connect", "first_byte", "dns", "dial"} {
+		assert.Contains(t, exported, name)
+	}
+	assert.Len(t, exported["request"]["shp.user"], 16)
+	assert.NotContains(t, exported["request"]["shp.user"], "@")
+	assert.False(t, strings.Contains(exported["connect"]["shp.address"], "127.0.0.1"))
+	assert.Equal(t, "connection refused", exported["dial"]["error"])
+
+	assert.Equal(t, "user@example.com", (*Tracing)(nil).User("user@example.com").Value.AsString())
+	assert.NoError(t, (*Tracing)(nil).Shutdown(context.Background()))
+}
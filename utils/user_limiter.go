@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The limits exceeded, used as the rejection reason
+const (
+	LimitConcurrentTunnels = "concurrent_tunnels"
+	LimitTunnelRate        = "tunnel_rate"
+	LimitRequestRate       = "request_rate"
+)
+
+// UserLimit of a user, zero means unlimited
+type UserLimit struct {
+	MaxTunnels     int     `yaml:"max_tunnels"`      // concurrent tunnels
+	TunnelsPerSec  float64 `yaml:"tunnels_per_sec"`  // new tunnels per second
+	RequestsPerSec float64 `yaml:"requests_per_sec"` // HTTP requests per second
+}
+
+// LimitsConfig the default limit and the overrides, an override replaces the default as a whole
+type LimitsConfig struct {
+	Default UserLimit            `yaml:"default"`
+	Users   map[string]UserLimit `yaml:"users"`
+}
+
+type userLimitState struct {
+	limit     UserLimit
+	tunnels   int
+	tunnelRL  *rate.Limiter
+	requestRL *rate.Limiter
+}
+
+// idle the state can be dropped, as a new one behaves the same
+func (s *userLimitState) idle(now time.Time) bool {
+	full := func(rl *rate.Limiter) bool {
+		return rl == nil || rl.TokensAt(now) >= float64(rl.Burst())
+	}
+	return s.tunnels == 0 && full(s.tunnelRL) && full(s.requestRL)
+}
+
+// userLimiterPruneInterval of the idle users
+const userLimiterPruneInterval = time.Minute
+
+// UserLimiter enforces the limits per user, a nil limiter allows everything
+type UserLimiter struct {
+	config   LimitsConfig
+	l        sync.Mutex
+	users    map[string]*userLimitState
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewUserLimiter a UserLimiter
+func NewUserLimiter(config LimitsConfig) (u *UserLimiter) {
+	u = &UserLimiter{
+		config: config,
+		users:  make(map[string]*userLimitState),
+		stop:   make(chan struct{}),
+	}
+	go u.janitor()
+	return
+}
+
+// janitor prunes the idle users every userLimiterPruneInterval
+func (u *UserLimiter) janitor() {
+	ticker := time.NewTicker(userLimiterPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stop:
+			return
+		case now := <-ticker.C:
+			u.prune(now)
+		}
+	}
+}
+
+// Stop the janitor
+func (u *UserLimiter) Stop() {
+	if u == nil {
+		return
+	}
+	u.stopOnce.Do(func() { close(u.stop) })
+}
+
+func (u *UserLimiter) prune(now time.Time) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	for user, s := range u.users {
+		if s.idle(now) {
+			delete(u.users, user)
+		}
+	}
+}
+
+func newRateLimiter(perSec float64) *rate.Limiter {
+	if perSec <= 0 {
+		return nil
+	}
+	// allow a burst of one second
+	return rate.NewLimiter(rate.Limit(perSec), int(math.Max(1, math.Ceil(perSec))))
+}
+
+// state must be called with the lock held
+func (u *UserLimiter) state(user string) *userLimitState {
+	if s, ok := u.users[user]; ok {
+		return s
+	}
+	limit, ok := u.config.Users[user]
+	if !ok {
+		limit = u.config.Default
+	}
+	s := &userLimitState{
+		limit:     limit,
+		tunnelRL:  newRateLimiter(limit.TunnelsPerSec),
+		requestRL: newRateLimiter(limit.RequestsPerSec),
+	}
+	u.users[user] = s
+	return s
+}
+
+// AcquireTunnel reserves a tunnel for user, release must be called when the tunnel is done.
+// If it is not allowed, reason is the limit exceeded and release is nil.
+func (u *UserLimiter) AcquireTunnel(user string) (release func(), reason string) {
+	if u == nil {
+		return func() {}, ""
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+	s := u.state(user)
+	if s.limit.MaxTunnels > 0 && s.tunnels >= s.limit.MaxTunnels {
+		return nil, LimitConcurrentTunnels
+	}
+	if s.tunnelRL != nil && !s.tunnelRL.Allow() {
+		return nil, LimitTunnelRate
+	}
+	s.tunnels++
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			u.l.Lock()
+			defer u.l.Unlock()
+			s.tunnels--
+		})
+	}, ""
+}
+
+// AllowRequest reports the limit exceeded if the HTTP request of user is not allowed, or empty
+func (u *UserLimiter) AllowRequest(user string) string {
+	if u == nil {
+		return ""
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+	s := u.state(user)
+	if s.requestRL != nil && !s.requestRL.Allow() {
+		return LimitRequestRate
+	}
+	return ""
+}
+
+// Tunnels the count of concurrent tunnels of user
+func (u *UserLimiter) Tunnels(user string) int {
+	if u == nil {
+		return 0
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+	if s, ok := u.users[user]; ok {
+		return s.tunnels
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserLimiter(t *testing.T) {
+	u := NewUserLimiter(LimitsConfig{
+		Default: UserLimit{MaxTunnels: 2, RequestsPerSec: 2},
+		Users: map[string]UserLimit{
+			"vip": {TunnelsPerSec: 1},
+		},
+	})
+	defer u.Stop()
+
+	// concurrent tunnels
+	release1, reason := u.AcquireTunnel("user")
+	assert.Equal(t, "", reason)
+	_, reason = u.AcquireTunnel("user")
+	assert.Equal(t, "", reason)
+	_, reason = u.AcquireTunnel("user")
+	assert.Equal(t, LimitConcurrentTunnels, reason)
+	release1()
+	release1() // released only once
+	assert.Equal(t, 1, u.Tunnels("user"))
+	_, reason = u.AcquireTunnel("user")
+	assert.Equal(t, "", reason)
+
+	// requests per second, with a burst of one second
+	assert.Equal(t, "", u.AllowRequest("user"))
+	assert.Equal(t, "", u.AllowRequest("user"))
+	assert.Equal(t, LimitRequestRate, u.AllowRequest("user"))
+
+	// the override replaces the default
+	for range 5 {
+		assert.Equal(t, "", u.AllowRequest("vip"))
+	}
+	_, reason = u.AcquireTunnel("vip")
+	assert.Equal(t, "", reason)
+	_, reason = u.AcquireTunnel("vip")
+	assert.Equal(t, LimitTunnelRate, reason)
+	assert.Equal(t, 1, u.Tunnels("vip"))
+
+	// nil limiter allows everything
+	var nilLimiter *UserLimiter
+	release, reason := nilLimiter.AcquireTunnel("user")
+	assert.Equal(t, "", reason)
+	release()
+	assert.Equal(t, "", nilLimiter.AllowRequest("user"))
+	nilLimiter.Stop()
+}
+
+func TestUserLimiterPrune(t *testing.T) {
+	u := NewUserLimiter(LimitsConfig{Default: UserLimit{TunnelsPerSec: 1, RequestsPerSec: 1}})
+	defer u.Stop()
+	release, _ := u.AcquireTunnel("tunneling")
+	releaseLimited, _ := u.AcquireTunnel("limited")
+	releaseLimited()
+	u.AllowRequest("requesting")
+	u.prune(time.Now())
+	assert.Len(t, u.users, 3) // the rate limiters are not refilled yet
+
+	later := time.Now().Add(2 * time.Second)
+	u.prune(later)
+	assert.Len(t, u.users, 1)
+	assert.Equal(t, 1, u.Tunnels("tunneling"))
+	release()
+	u.prune(later)
+	assert.Empty(t, u.users)
+}
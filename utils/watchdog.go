@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimeoutConfig of the proxied connections, zero disables each of them
+type TimeoutConfig struct {
+	Idle           time.Duration `yaml:"idle"`            // no bytes in either direction
+	MaxLifetime    time.Duration `yaml:"max_lifetime"`    // of a tunnel or an HTTP request
+	RequestHeader  time.Duration `yaml:"request_header"`  // to read the request header from the client
+	ResponseHeader time.Duration `yaml:"response_header"` // to receive the response header of plain HTTP
+	KeepAlive      time.Duration `yaml:"keep_alive"`      // TCP keepalive of the accepted connections, default 15 seconds, negative disables it
+}
+
+const (
+	// TimeoutIdle no bytes in either direction for too long
+	TimeoutIdle = "idle_timeout"
+	// TimeoutMaxLifetime the connection lives too long
+	TimeoutMaxLifetime = "max_lifetime"
+	// TimeoutResponseHeader the response header is not received in time
+	TimeoutResponseHeader = "response_header_timeout"
+)
+
+// Watchdog closes a connection when it is idle or lives too long.
+// A nil Watchdog never fires.
+type Watchdog struct {
+	idle       time.Duration
+	lastActive atomic.Int64 // unix nano
+	reason     atomic.Value // string, set when fired
+	close      func()
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewWatchdog starts watching, close is called when it fires, returns nil if no timeout is configured
+func NewWatchdog(config TimeoutConfig, close func()) *Watchdog {
+	if config.Idle <= 0 && config.MaxLifetime <= 0 {
+		return nil
+	}
+	w := &Watchdog{
+		idle:  config.Idle,
+		close: close,
+		done:  make(chan struct{}),
+	}
+	w.Touch()
+	go w.watch(config.MaxLifetime)
+	return w
+}
+
+func (w *Watchdog) watch(maxLifetime time.Duration) {
+	lifetime := (<-chan time.Time)(nil)
+	if maxLifetime > 0 {
+		timer := time.NewTimer(maxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	idle, idleTimer := (<-chan time.Time)(nil), (*time.Timer)(nil)
+	if w.idle > 0 {
+		idleTimer = time.NewTimer(w.idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-lifetime:
+			w.fire(TimeoutMaxLifetime)
+			return
+		case <-idle:
+			if inactive := time.Since(time.Unix(0, w.lastActive.Load())); inactive < w.idle {
+				idleTimer.Reset(w.idle - inactive)
+				continue
+			}
+			w.fire(TimeoutIdle)
+			return
+		}
+	}
+}
+
+func (w *Watchdog) fire(reason string) {
+	w.reason.Store(reason)
+	w.close()
+}
+
+// Touch records the activity of the connection
+func (w *Watchdog) Touch() {
+	if w != nil {
+		w.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// Stop watching, when the connection is done
+func (w *Watchdog) Stop() {
+	if w != nil {
+		w.stopOnce.Do(func() { close(w.done) })
+	}
+}
+
+// Reason why it fired, empty if not
+func (w *Watchdog) Reason() string {
+	if w == nil {
+		return ""
+	}
+	reason, _ := w.reason.Load().(string)
+	return reason
+}
+
+type watchdogWriter struct {
+	w  io.Writer
+	wd *Watchdog
+}
+
+func (t *watchdogWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		t.wd.Touch()
+	}
+	return n, err
+}
+
+// Writer touches the watchdog on every write to dst
+func (w *Watchdog) Writer(dst io.Writer) io.Writer {
+	if w == nil {
+		return dst
+	}
+	return &watchdogWriter{dst, w}
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchdogIdle(t *testing.T) {
+	closed := atomic.Bool{}
+	w := NewWatchdog(TimeoutConfig{Idle: 100 * time.Millisecond}, func() { closed.Store(true) })
+	defer w.Stop()
+	writer := w.Writer(io.Discard)
+	// the writes keep it alive
+	for range 5 {
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte("x"))
+	}
+	assert.False(t, closed.Load())
+	assert.Eventually(t, closed.Load, time.Second, 10*time.Millisecond)
+	assert.Equal(t, TimeoutIdle, w.Reason())
+}
+
+func TestWatchdogMaxLifetime(t *testing.T) {
+	closed := atomic.Bool{}
+	w := NewWatchdog(TimeoutConfig{Idle: time.Second, MaxLifetime: 100 * time.Millisecond}, func() { closed.Store(true) })
+	defer w.Stop()
+	assert.Eventually(t, closed.Load, time.Second, 10*time.Millisecond)
+	assert.Equal(t, TimeoutMaxLifetime, w.Reason())
+}
+
+func TestWatchdogStopAndDisabled(t *testing.T) {
+	closed := atomic.Bool{}
+	w := NewWatchdog(TimeoutConfig{Idle: 50 * time.Millisecond}, func() { closed.Store(true) })
+	w.Stop()
+	w.Stop()
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, closed.Load())
+	assert.Equal(t, "", w.Reason())
+
+	// nil is disabled
+	w = NewWatchdog(TimeoutConfig{RequestHeader: time.Second}, nil)
+	assert.Nil(t, w)
+	assert.Equal(t, io.Discard, w.Writer(io.Discard))
+	w.Touch()
+	w.Stop()
+	assert.Equal(t, "", w.Reason())
+}